@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a single JSON line in the audit log
+type auditRecord struct {
+	Timestamp           string `json:"timestamp"`
+	Command             string `json:"command"`
+	WorkingDir          string `json:"working_dir,omitempty"`
+	Allowed             bool   `json:"allowed"`
+	Reason              string `json:"reason,omitempty"`
+	ExitCode            *int   `json:"exit_code,omitempty"`
+	DurationMs          int64  `json:"duration_ms"`
+	Attempts            int    `json:"attempts,omitempty"`
+	Pid                 int    `json:"pid,omitempty"`
+	Bypass              bool   `json:"bypass,omitempty"`
+	MatchedAllowPattern string `json:"matched_allow_pattern,omitempty"`
+	Agent               string `json:"agent,omitempty"`
+	CorrelationID       string `json:"correlation_id,omitempty"`
+	Alias               string `json:"alias,omitempty"`
+}
+
+// auditMu serializes audit writes within this process; O_APPEND keeps each
+// line intact across processes sharing the same log.
+var auditMu sync.Mutex
+
+// newAuditRecord builds a record for command from its execution result, or
+// from the rejection/execution error when there is no result.
+func newAuditRecord(command, workingDir string, result map[string]interface{}, err error) auditRecord {
+	record := auditRecord{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+		Command:    command,
+		WorkingDir: workingDir,
+		Allowed:    result != nil,
+	}
+	if err != nil {
+		record.Reason = err.Error()
+	}
+	if result != nil {
+		code := exitCode(result)
+		record.ExitCode = &code
+		record.DurationMs, _ = result["duration_ms"].(int64)
+		record.Attempts, _ = result["attempts"].(int)
+		record.Pid, _ = result["pid"].(int)
+	}
+	return record
+}
+
+// writeAuditLog appends record to the log at path. It is best-effort: a
+// failed write is reported on stderr but never fails the command.
+func writeAuditLog(path string, record auditRecord) {
+	if path == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(expandPath(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ori-shell-executor: failed to open audit log: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	// A single write per line so concurrent appenders never interleave
+	if _, err := f.Write(line); err != nil {
+		fmt.Fprintf(os.Stderr, "ori-shell-executor: failed to write audit log: %v\n", err)
+	}
+}
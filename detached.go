@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// detachedOutputBytes caps the output kept per stream for a detached command.
+// Only the newest bytes are kept, since a server or watcher may run for hours.
+const detachedOutputBytes = 64 << 10
+
+// detachedRetention is how long a finished detached command stays queryable
+const detachedRetention = 10 * time.Minute
+
+// detachedProc is a command started with detach: true. It runs in its own
+// process group until it exits or is stopped with the cancel action, and is
+// reaped by a goroutine that records its exit.
+type detachedProc struct {
+	runID      string
+	command    string
+	pid        int
+	startedAt  time.Time
+	redactions []*regexp.Regexp
+
+	mu         sync.Mutex // guards the buffers and the fields below
+	stdout     *cappedBuffer
+	stderr     *cappedBuffer // nil when combining output
+	finished   bool
+	finishedAt time.Time
+	exitCode   int
+	cancelled  bool
+}
+
+// detachedWriter appends to one of a detached command's buffers under its lock
+type detachedWriter struct {
+	proc *detachedProc
+	buf  *cappedBuffer
+}
+
+func (w detachedWriter) Write(p []byte) (int, error) {
+	w.proc.mu.Lock()
+	defer w.proc.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// detachedRegistry holds the detached commands by run id
+type detachedRegistry struct {
+	mu    sync.Mutex
+	procs map[string]*detachedProc
+}
+
+var detachedProcs = &detachedRegistry{procs: make(map[string]*detachedProc)}
+
+// get returns the detached command with runID, if it is known
+func (r *detachedRegistry) get(runID string) (*detachedProc, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	proc, ok := r.procs[runID]
+	return proc, ok
+}
+
+// startDetached starts opts.Command without waiting for it and registers it
+// under runID, both here and with activeRuns so the cancel action stops it.
+// The timeout does not apply and no execution slot is held.
+func startDetached(runID string, opts execOptions) (map[string]interface{}, error) {
+	if len(opts.Argv) == 0 && len(opts.CommandPrefix) == 0 {
+		if err := checkShellAvailable(opts.Shell, opts.PathOverride); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	grace := time.Duration(opts.GraceSeconds) * time.Second
+	commandLine := buildCommandLine(opts.CommandPrefix, opts.Argv, opts.Shell, opts.Command)
+	cmd := exec.CommandContext(ctx, commandLine[0], commandLine[1:]...)
+	applyPathOverride(cmd, commandLine[0], opts.PathOverride)
+	stopKill := configureProcessGroup(cmd, grace)
+	cmd.WaitDelay = grace + outputDrainDelay
+	if err := setCredential(cmd, opts.RunAsUID, opts.RunAsGID); err != nil {
+		cancel()
+		return nil, err
+	}
+	cmd.Dir = opts.WorkingDir
+	cmd.Env = commandEnv(opts.Env, opts)
+	if opts.Stdin != "" {
+		cmd.Stdin = strings.NewReader(opts.Stdin)
+	}
+
+	limit := func(configured int) int {
+		if configured > 0 {
+			return min(detachedOutputBytes, configured)
+		}
+		return detachedOutputBytes
+	}
+	stdoutLimit, stderrLimit := opts.streamLimits()
+	if opts.CombineOutput {
+		stdoutLimit = opts.MaxOutputBytes
+	}
+	proc := &detachedProc{
+		runID:      runID,
+		command:    opts.Command,
+		redactions: opts.Redactions,
+		stdout:     newCappedBuffer(limit(stdoutLimit), truncateModeTail),
+	}
+	cmd.Stdout = detachedWriter{proc: proc, buf: proc.stdout}
+	if opts.CombineOutput {
+		cmd.Stderr = cmd.Stdout
+	} else {
+		proc.stderr = newCappedBuffer(limit(stderrLimit), truncateModeTail)
+		cmd.Stderr = detachedWriter{proc: proc, buf: proc.stderr}
+	}
+
+	// Output files replace the buffers for their stream
+	var files []*os.File
+	for _, out := range []struct {
+		path string
+		dest *io.Writer
+	}{{opts.StdoutFile, &cmd.Stdout}, {opts.StderrFile, &cmd.Stderr}} {
+		if out.path == "" {
+			continue
+		}
+		f, err := os.Create(out.path)
+		if err != nil {
+			cancel()
+			closeFiles(files)
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		files = append(files, f)
+		*out.dest = f
+	}
+
+	if err := activeRuns.register(runID, cancel); err != nil {
+		cancel()
+		closeFiles(files)
+		return nil, err
+	}
+	if err := startCommand(cmd, opts.Umask); err != nil {
+		activeRuns.unregister(runID)
+		cancel()
+		closeFiles(files)
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	proc.pid = cmd.Process.Pid
+	niced := setNice(cmd, opts.Nice)
+	proc.startedAt = time.Now()
+
+	detachedProcs.mu.Lock()
+	detachedProcs.procs[runID] = proc
+	detachedProcs.mu.Unlock()
+
+	// Reap the command, then keep its final state around for a while
+	go func() {
+		cmd.Wait()
+		stopKill()
+		cancelled := ctx.Err() != nil
+		cancel()
+		closeFiles(files)
+		activeRuns.unregister(runID)
+
+		proc.mu.Lock()
+		proc.finished = true
+		proc.finishedAt = time.Now()
+		proc.exitCode = cmd.ProcessState.ExitCode()
+		proc.cancelled = cancelled
+		proc.mu.Unlock()
+
+		time.AfterFunc(detachedRetention, func() {
+			detachedProcs.mu.Lock()
+			defer detachedProcs.mu.Unlock()
+			if detachedProcs.procs[runID] == proc {
+				delete(detachedProcs.procs, runID)
+			}
+		})
+	}()
+
+	result := map[string]interface{}{
+		"command":      opts.Command,
+		"command_line": commandLine,
+		"working_dir":  opts.WorkingDir,
+		"run_id":       runID,
+		"pid":          proc.pid,
+		"detached":     true,
+		"status":       statusRunning,
+		"started_at":   proc.startedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if len(opts.Argv) > 0 {
+		result["argv"] = opts.Argv
+	} else {
+		result["shell"] = opts.Shell
+	}
+	if niced {
+		result["nice"] = opts.Nice
+	}
+	if opts.StdoutFile != "" {
+		result["stdout_file"] = opts.StdoutFile
+	}
+	if opts.StderrFile != "" {
+		result["stderr_file"] = opts.StderrFile
+	}
+	return result, nil
+}
+
+// closeFiles closes each of files
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// detachedStatus reports the state of the detached command with runID and
+// the newest output it produced
+func detachedStatus(runID string) (string, error) {
+	if runID == "" {
+		return "", fmt.Errorf("run_id is required for the status action")
+	}
+	proc, ok := detachedProcs.get(runID)
+	if !ok {
+		return "", fmt.Errorf("no detached command with run_id '%s'", runID)
+	}
+
+	proc.mu.Lock()
+	result := map[string]interface{}{
+		"action":     actionStatus,
+		"run_id":     runID,
+		"command":    proc.command,
+		"pid":        proc.pid,
+		"running":    !proc.finished,
+		"started_at": proc.startedAt.UTC().Format(time.RFC3339Nano),
+		"truncated":  proc.stdout.Truncated() || (proc.stderr != nil && proc.stderr.Truncated()),
+	}
+	if proc.stderr == nil {
+		result["combined"] = redactString(proc.stdout.String(), proc.redactions)
+	} else {
+		result["stdout"] = redactString(proc.stdout.String(), proc.redactions)
+		result["stderr"] = redactString(proc.stderr.String(), proc.redactions)
+		result["stdout_truncated"] = proc.stdout.Truncated()
+		result["stderr_truncated"] = proc.stderr.Truncated()
+	}
+	switch {
+	case !proc.finished:
+		result["status"] = statusRunning
+	case proc.cancelled:
+		result["status"] = statusCancelled
+	case proc.exitCode == 0:
+		result["status"] = statusSuccess
+	default:
+		result["status"] = statusFailed
+	}
+	if proc.finished {
+		result["exit_code"] = proc.exitCode
+		result["finished_at"] = proc.finishedAt.UTC().Format(time.RFC3339Nano)
+		result["duration_ms"] = proc.finishedAt.Sub(proc.startedAt).Milliseconds()
+	}
+	proc.mu.Unlock()
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// redactString replaces every match of redactions in s
+func redactString(s string, redactions []*regexp.Regexp) string {
+	for _, re := range redactions {
+		s = re.ReplaceAllString(s, redactedText)
+	}
+	return s
+}
@@ -0,0 +1,38 @@
+package main
+
+import "errors"
+
+// Sentinel errors wrapped by validation and execution failures so callers can
+// tell policy rejections from command failures with errors.Is. The wrapping
+// errors keep the human-readable detail (pattern, operator, exit code).
+var (
+	// ErrBlockedPattern means the command matched a blocked pattern
+	ErrBlockedPattern = errors.New("command blocked by security policy")
+
+	// ErrNotAllowed means the command matched none of the allowed patterns
+	ErrNotAllowed = errors.New("command not in allowed list")
+
+	// ErrShellMetacharacters means the command used a disallowed shell operator
+	ErrShellMetacharacters = errors.New("command contains shell metacharacter")
+
+	// ErrCommandTooLong means the command exceeded max_command_length
+	ErrCommandTooLong = errors.New("command too long")
+
+	// ErrControlCharacter means the command contained a NUL byte or another
+	// non-printable control character
+	ErrControlCharacter = errors.New("command contains control character")
+
+	// ErrOutsidePathRoots means an argument of the command names a path
+	// outside allowed_path_roots, or one that cannot be checked
+	ErrOutsidePathRoots = errors.New("command argument outside allowed path roots")
+
+	// ErrTimeout means the command was killed after exceeding its timeout
+	ErrTimeout = errors.New("command timed out")
+
+	// ErrNonZeroExit means the command ran but exited with a non-zero code
+	ErrNonZeroExit = errors.New("command failed")
+
+	// ErrExpectationFailed means the command ran but its exit code or stdout
+	// was not what expect_exit_code or expect_stdout_regex asked for
+	ErrExpectationFailed = errors.New("expectation not met")
+)
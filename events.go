@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Supported values for the stream_format parameter
+const (
+	streamFormatLines  = "lines"
+	streamFormatNDJSON = "ndjson"
+)
+
+// eventStream is the stream name under which NDJSON events reach the
+// OutputHandler
+const eventStream = "event"
+
+// Values of the type field of an NDJSON event
+const (
+	eventTypeStart  = "start"
+	eventTypeOutput = "output"
+	eventTypeResult = "result"
+)
+
+// streamEvent is one line of the transcript produced with stream_format
+// ndjson: a start event, an output event per line, then a result event.
+// Every event has type, run_id and time; the rest depends on the type. The
+// field names are a stable schema, so only add to them.
+type streamEvent struct {
+	Type  string `json:"type"`
+	RunID string `json:"run_id"`
+	Time  string `json:"time"`
+
+	// start
+	Command    string   `json:"command,omitempty"`
+	Shell      string   `json:"shell,omitempty"`
+	Argv       []string `json:"argv,omitempty"`
+	WorkingDir string   `json:"working_dir,omitempty"`
+
+	// output
+	Stream string  `json:"stream,omitempty"` // stdout, stderr or combined
+	Line   *string `json:"line,omitempty"`
+
+	// result
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Status     string `json:"status,omitempty"`
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// emitEvent stamps event with the current time and delivers it to handler as
+// a single JSON line
+func emitEvent(handler OutputHandler, event streamEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, _ := json.Marshal(event)
+	handler(eventStream, string(line))
+}
+
+// eventOutputHandler wraps handler so each streamed line is delivered as an
+// output event of runID
+func eventOutputHandler(handler OutputHandler, runID string) OutputHandler {
+	return func(stream, line string) {
+		emitEvent(handler, streamEvent{Type: eventTypeOutput, RunID: runID, Stream: stream, Line: &line})
+	}
+}
+
+// resultEvent summarizes a finished run for the final event. err is the
+// error that kept the command from producing a result, if any.
+func resultEvent(runID string, result map[string]interface{}, err error) streamEvent {
+	event := streamEvent{Type: eventTypeResult, RunID: runID}
+	if err != nil {
+		event.Status = statusFailed
+		event.Error = err.Error()
+		return event
+	}
+	if code, ok := result["exit_code"].(int); ok {
+		event.ExitCode = &code
+	}
+	if duration, ok := result["duration_ms"].(int64); ok {
+		event.DurationMs = &duration
+	}
+	event.Status, _ = result["status"].(string)
+	event.Error, _ = result["error"].(string)
+	return event
+}
@@ -2,7 +2,10 @@ module github.com/johnjallday/ori-agent/plugins/ori-shell-executor
 
 go 1.25.5
 
-require github.com/johnjallday/ori-agent v0.0.0
+require (
+	github.com/johnjallday/ori-agent v0.0.0
+	golang.org/x/text v0.32.0
+)
 
 require (
 	github.com/Masterminds/semver/v3 v3.4.0 // indirect
@@ -16,7 +19,6 @@ require (
 	github.com/oklog/run v1.2.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
-	golang.org/x/text v0.32.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251111163417-95abcf5c77ba // indirect
 	google.golang.org/grpc v1.77.0 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// execLimiter is a counting semaphore whose limit is supplied on each acquire,
+// so a max_concurrent change in the settings file applies to the next call.
+type execLimiter struct {
+	mu       sync.Mutex
+	active   int
+	released chan struct{}
+}
+
+// execSlots throttles concurrent command executions across all calls
+var execSlots = &execLimiter{}
+
+// acquire blocks until fewer than limit executions are active, or ctx is done.
+// A limit of 0 or less means unlimited. Every successful acquire must be
+// paired with release.
+func (l *execLimiter) acquire(ctx context.Context, limit int) error {
+	for {
+		l.mu.Lock()
+		if limit <= 0 || l.active < limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release frees a slot and wakes any waiting acquirers
+func (l *execLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
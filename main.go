@@ -4,19 +4,36 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/johnjallday/ori-agent/pluginapi"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
 //go:embed plugin.yaml
@@ -26,20 +43,120 @@ var configYAML string
 // Note: Compile-time interface check is in ori_shell_executor_generated.go
 type ori_shell_executorTool struct {
 	pluginapi.BasePlugin
+
+	// outputHandler receives output lines in streaming mode; nil uses defaultOutputHandler
+	outputHandler OutputHandler
+
+	// bypassToken, set from the bypass_token config in InitializeWithConfig,
+	// lets trusted callers skip the allowed/blocked pattern checks
+	bypassToken string
+}
+
+// OutputHandler receives a single line of command output as it is produced.
+// stream is "stdout", "stderr" or "combined"; a "run_id" line announcing the
+// run's id comes first. With stream_format ndjson every line is instead an
+// "event" holding one JSON-encoded streamEvent.
+type OutputHandler func(stream, line string)
+
+// execOptions holds the resolved parameters for a single command execution
+type execOptions struct {
+	Command        string
+	Argv           []string // run directly without a shell when set; Command is then the joined form
+	WorkingDir     string
+	TimeoutSeconds int
+	GraceSeconds   int    // time between SIGTERM and SIGKILL on timeout or cancel
+	Shell          string // resolved shell name, see resolveShell
+	Env            map[string]string
+	EnvAllowlist   []string // inherited variables to keep, by name or glob; empty keeps all
+	EnvBlocklist   []string // inherited variables to drop, by name or glob
+	PathOverride   []string // trusted directories that replace PATH
+	Stdin          string
+	Stream         bool
+	TeeToConsole   bool          // also copy output to the plugin's own stdout/stderr
+	StreamHandler  OutputHandler // receives streamed lines; nil uses the tool's handler
+	CombineOutput  bool
+	MaxOutputBytes int
+	MaxStdoutBytes int // stdout limit when not combining; 0 falls back to MaxOutputBytes
+	MaxStderrBytes int // stderr limit when not combining; 0 falls back to MaxOutputBytes
+	TruncateMode   string
+	MaxConcurrent  int
+	RunAsUID       *int
+	RunAsGID       *int
+	Umask          *int // file mode creation mask for the command (Unix only)
+	Nice           int  // scheduling niceness, 0-19 (Unix only)
+	OutputEncoding encoding.Encoding
+	CommandPrefix  []string // wrapper program and arguments prepended to the command line
+	TrackCwd       bool     // report the shell's final directory as final_working_dir
+	StdoutFile     string   // absolute path that receives stdout instead of the result
+	StderrFile     string   // absolute path that receives stderr instead of the result
+	Redactions     []*regexp.Regexp
 }
 
 // Settings loaded from agent config
 type Settings struct {
-	TimeoutSeconds           int      `json:"timeout_seconds"`
-	DefaultWorkingDir        string   `json:"default_working_dir"`
-	AllowedPatterns          []string `json:"allowed_patterns"`
-	BlockedPatterns          []string `json:"blocked_patterns"`
-	AllowShellMetacharacters bool     `json:"allow_shell_metacharacters"`
+	TimeoutSeconds           int                 `json:"timeout_seconds"`
+	MaxTimeoutSeconds        int                 `json:"max_timeout_seconds"`
+	GraceSeconds             int                 `json:"grace_seconds"`
+	Nice                     int                 `json:"nice"`
+	MaxCommandLength         int                 `json:"max_command_length"`
+	DefaultWorkingDir        string              `json:"default_working_dir"`
+	DefaultShell             string              `json:"default_shell"`
+	AllowedShells            []string            `json:"allowed_shells"`
+	AllowedPatterns          []string            `json:"allowed_patterns"`
+	EnforceAllowlist         bool                `json:"enforce_allowlist"`
+	AllowedSubcommands       map[string][]string `json:"allowed_subcommands"`
+	ProgramAliases           map[string][]string `json:"program_aliases"`
+	BlockedPatterns          []string            `json:"blocked_patterns"`
+	ConfirmPatterns          []string            `json:"confirm_patterns"`
+	AdvisoryPatterns         []string            `json:"advisory_patterns"`
+	PatternReasons           map[string]string   `json:"pattern_reasons,omitempty"`
+	AllowShellMetacharacters bool                `json:"allow_shell_metacharacters"`
+	PatternSyntax            string              `json:"pattern_syntax"`
+	CaseInsensitiveMatching  bool                `json:"case_insensitive_matching"`
+	MaxOutputBytes           int                 `json:"max_output_bytes"`
+	MaxStdoutBytes           int                 `json:"max_stdout_bytes"`
+	MaxStderrBytes           int                 `json:"max_stderr_bytes"`
+	TruncateMode             string              `json:"truncate_mode"`
+	AllowedMetacharacters    []string            `json:"allowed_metacharacters"`
+	BlockedMetacharacters    []string            `json:"blocked_metacharacters"`
+	AllowedWorkingDirs       []string            `json:"allowed_working_dirs"`
+	AllowedPathRoots         []string            `json:"allowed_path_roots"`
+	OutputEncoding           string              `json:"output_encoding"`
+	AuditLogPath             string              `json:"audit_log_path"`
+	TeeToConsole             bool                `json:"tee_to_console"`
+	CommandTemplates         map[string]string   `json:"command_templates"`
+	Aliases                  map[string]string   `json:"aliases"`
+	MaxConcurrent            int                 `json:"max_concurrent"`
+	RunAsUID                 *int                `json:"run_as_uid,omitempty"`
+	RunAsGID                 *int                `json:"run_as_gid,omitempty"`
+	Umask                    string              `json:"umask,omitempty"`
+	TrimPatterns             bool                `json:"trim_patterns"`
+	Disabled                 bool                `json:"disabled"`
+	AllowedPatternsFile      string              `json:"allowed_patterns_file"`
+	BlockedPatternsFile      string              `json:"blocked_patterns_file"`
+	CommandPrefix            []string            `json:"command_prefix"`
+	SessionIdleTimeout       int                 `json:"session_idle_timeout_seconds"`
+	RedactionPatterns        []string            `json:"redaction_patterns"`
+	EnvAllowlist             []string            `json:"env_allowlist"`
+	EnvBlocklist             []string            `json:"env_blocklist"`
+	PathOverride             []string            `json:"path_override"`
 }
 
+// Supported values for Settings.PatternSyntax
+const (
+	patternSyntaxGlob  = "glob"
+	patternSyntaxRegex = "regex"
+	patternSyntaxPath  = "path"
+)
+
+// programPatternPrefix marks a pattern that matches on the program name
+// alone, e.g. "prog:git" for any git invocation
+const programPatternPrefix = "prog:"
+
 // Default settings
 var defaultSettings = Settings{
 	TimeoutSeconds:    60,
+	MaxTimeoutSeconds: 300,
 	DefaultWorkingDir: "",
 	AllowedPatterns: []string{
 		"./scripts/*",
@@ -55,7 +172,8 @@ var defaultSettings = Settings{
 		"env",
 	},
 	BlockedPatterns: []string{
-		"rm -rf /*",
+		"rm -rf /*", // the * may be empty, so this also blocks "rm -rf /"
+		"rm -rf ~",
 		"rm -rf ~/*",
 		"sudo *",
 		"> /dev/*",
@@ -69,414 +187,3845 @@ var defaultSettings = Settings{
 		"mkfs.*",
 		"eval *",
 	},
+	EnforceAllowlist:         true,
 	AllowShellMetacharacters: false,
+	PatternSyntax:            patternSyntaxGlob,
+	MaxOutputBytes:           1 << 20,
+	TruncateMode:             truncateModeHead,
+	TrimPatterns:             true,
+	SessionIdleTimeout:       600,
 }
 
+// Supported values for the action parameter
+const (
+	actionExecute              = "execute"
+	actionGetSettings          = "get_settings"
+	actionCancel               = "cancel"
+	actionCloseSession         = "close_session"
+	actionSelftest             = "selftest"
+	actionGetStats             = "get_stats"
+	actionGetEffectivePatterns = "get_effective_patterns"
+	actionStatus               = "status"
+	actionTestPattern          = "test_pattern"
+)
+
+// Values of the source field in get_effective_patterns entries
+const (
+	patternSourceDefault  = "default"
+	patternSourceSettings = "settings"
+	patternSourceFile     = "file"
+	patternSourceParam    = "param"
+)
+
+// Supported values for the output_format parameter
+const (
+	outputFormatJSON = "json"
+	outputFormatText = "text"
+)
+
+// Supported values for the glob_no_match parameter
+const (
+	globNoMatchLiteral = "literal"
+	globNoMatchError   = "error"
+)
+
+// Values of the error_kind result field and the exit codes that go with them
+const (
+	errorKindTimeout   = "timeout"
+	errorKindNotFound  = "not_found"
+	errorKindExecError = "exec_error"
+	errorKindCancelled = "cancelled"
+
+	exitCodeNotFound  = 127
+	exitCodeExecError = -1
+)
+
+// Values of the status result field, a summary of the outcome
+const (
+	statusSuccess           = "success"
+	statusFailed            = "failed"
+	statusTimeout           = "timeout"
+	statusBlocked           = "blocked"
+	statusNotFound          = "not_found"
+	statusCancelled         = "cancelled"
+	statusNeedsConfirmation = "needs_confirmation"
+	statusRunning           = "running"
+)
+
+// outputDrainDelay is how long Wait keeps collecting output after a timed out
+// or cancelled command was killed. A background process that escaped the kill
+// can hold the pipes open; without a limit Wait would block on it and the
+// output captured so far would never be returned.
+const outputDrainDelay = 2 * time.Second
+
 // Note: Definition() is inherited from BasePlugin, which automatically reads from plugin.yaml
 // Note: Call() is auto-generated in ori_shell_executor_generated.go from plugin.yaml
 
 // Execute contains the business logic - called by the generated Call() method
 func (t *ori_shell_executorTool) Execute(ctx context.Context, params *OriShellExecutorParams) (string, error) {
-	if params.Command == "" {
-		return "", fmt.Errorf("command is required")
-	}
-
 	// Load settings
-	settings := t.loadSettings()
+	settings, source := t.loadSettingsWithSource()
 
-	// Reject shell metacharacters unless explicitly allowed
-	if err := t.validateShellMetacharacters(params.Command, settings.AllowShellMetacharacters); err != nil {
-		return "", err
+	// Reporting settings is read-only, so it stays available while disabled
+	if params.Action == actionGetSettings {
+		return t.settingsResult(settings, source)
 	}
 
-	// Validate command against blocked patterns
-	if err := t.validateNotBlocked(params.Command, settings.BlockedPatterns); err != nil {
-		return "", err
+	// The rejection counts and pattern lists are read-only too
+	if params.Action == actionGetStats {
+		return statsResult()
 	}
-
-	// Validate command against allowed patterns
-	if err := t.validateAllowed(params.Command, settings.AllowedPatterns); err != nil {
-		return "", err
+	if params.Action == actionGetEffectivePatterns {
+		return t.effectivePatternsResult(params)
 	}
-
-	// Determine working directory: params > settings > agent context > cwd
-	workingDir := params.WorkingDir
-	if workingDir == "" {
-		if settings.DefaultWorkingDir != "" {
-			workingDir = expandTilde(settings.DefaultWorkingDir)
-		} else {
-			agentCtx := t.GetAgentContext()
-			workingDir = agentCtx.AgentDir
-			if workingDir == "" {
-				var err error
-				workingDir, err = os.Getwd()
-				if err != nil {
-					return "", fmt.Errorf("failed to get working directory: %w", err)
-				}
-			}
-		}
+	if params.Action == actionStatus {
+		return detachedStatus(params.RunID)
+	}
+	if params.Action == actionTestPattern {
+		return testPatternResult(params.Pattern, params.Commands, settings)
 	}
 
-	// Determine timeout
-	timeout := params.TimeoutSeconds
-	if timeout <= 0 {
-		timeout = settings.TimeoutSeconds
+	// Cancelling only stops work, so it also stays available while disabled
+	if params.Action == actionCancel {
+		return cancelRun(params.RunID)
 	}
-	if timeout <= 0 {
-		timeout = 60
+	if params.Action == actionCloseSession {
+		return closeSession(params.SessionID)
 	}
-	if timeout > 300 {
-		timeout = 300
+
+	// The kill switch rejects every call, even malformed ones, before anything else
+	if settings.Disabled {
+		return "", fmt.Errorf("shell executor is disabled by configuration")
 	}
 
-	// Execute command
-	result, err := t.executeCommand(ctx, params.Command, workingDir, timeout, params.Shell)
-	if err != nil {
-		return "", err
+	if params.Action == actionSelftest {
+		return t.selftest(ctx, settings)
 	}
 
-	return result, nil
-}
+	if params.Action != "" && params.Action != actionExecute {
+		return "", fmt.Errorf("unknown action '%s'", params.Action)
+	}
 
-// parseLines splits a newline-separated string into a slice, trimming whitespace
-func parseLines(s string) []string {
-	if s == "" {
-		return nil
+	switch params.OutputFormat {
+	case "", outputFormatJSON, outputFormatText:
+	default:
+		return "", fmt.Errorf("unsupported output_format '%s': use json or text", params.OutputFormat)
 	}
-	lines := strings.Split(s, "\n")
-	result := make([]string, 0, len(lines))
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line != "" {
-			result = append(result, line)
+
+	// A batch runs each command through this same pipeline
+	if len(params.Commands) > 0 {
+		if params.Command != "" || params.CommandFile != "" || params.Template != "" || len(params.Argv) > 0 {
+			return "", fmt.Errorf("commands is mutually exclusive with command, command_file, template and argv")
 		}
+		return t.executeBatch(ctx, params)
 	}
-	return result
-}
 
-func parseStringList(value interface{}) []string {
-	switch v := value.(type) {
-	case string:
-		return parseLines(v)
-	case []string:
-		return v
-	case []interface{}:
-		result := make([]string, 0, len(v))
-		for _, item := range v {
-			if s, ok := item.(string); ok {
-				s = strings.TrimSpace(s)
-				if s != "" {
-					result = append(result, s)
-				}
-			}
+	// Argv runs a program directly, so nothing shell-related applies to it
+	if len(params.Argv) > 0 && (params.Command != "" || params.Template != "" || params.Shell != "" || params.ShellPath != "") {
+		return "", fmt.Errorf("argv is mutually exclusive with command, template, shell and shell_path")
+	}
+	if params.ParseStdoutJSON && (params.CombineOutput || params.OutputFormat == outputFormatText) {
+		return "", fmt.Errorf("parse_stdout_json cannot be combined with combine_output or output_format text")
+	}
+	if params.CompressOutput && (params.ParseStdoutJSON || params.OutputFormat == outputFormatText) {
+		return "", fmt.Errorf("compress_output cannot be combined with parse_stdout_json or output_format text")
+	}
+	if params.Detach && (params.SessionID != "" || params.Stream || params.TrackCwd || params.Retries > 0 || params.OutputFormat == outputFormatText) {
+		return "", fmt.Errorf("detach cannot be combined with session_id, stream, track_cwd, retries or output_format text")
+	}
+	if (params.StdoutFile != "" || params.StderrFile != "") && params.CombineOutput {
+		return "", fmt.Errorf("stdout_file and stderr_file cannot be combined with combine_output")
+	}
+	if params.StdoutFile != "" && params.ParseStdoutJSON {
+		return "", fmt.Errorf("stdout_file cannot be combined with parse_stdout_json")
+	}
+	if params.Nice < 0 || params.Nice > maxNice {
+		return "", fmt.Errorf("nice must be between 0 and %d, got %d", maxNice, params.Nice)
+	}
+	switch params.StreamFormat {
+	case "", streamFormatLines:
+	case streamFormatNDJSON:
+		if !params.Stream {
+			return "", fmt.Errorf("stream_format ndjson requires stream")
 		}
-		return result
 	default:
-		return nil
+		return "", fmt.Errorf("unsupported stream_format '%s': use lines or ndjson", params.StreamFormat)
 	}
-}
-
-func parseBool(value interface{}) (bool, bool) {
-	switch v := value.(type) {
-	case bool:
-		return v, true
-	case string:
-		parsed, err := strconv.ParseBool(v)
-		if err == nil {
-			return parsed, true
+	if params.ExpandGlobs && len(params.Argv) == 0 {
+		return "", fmt.Errorf("expand_globs requires argv")
+	}
+	switch params.GlobNoMatch {
+	case "", globNoMatchLiteral, globNoMatchError:
+	default:
+		return "", fmt.Errorf("unsupported glob_no_match '%s': use literal or error", params.GlobNoMatch)
+	}
+	if params.ExpectStdoutRegex != "" || params.ExpectExitCode != nil {
+		if params.Detach {
+			return "", fmt.Errorf("expect_stdout_regex and expect_exit_code cannot be combined with detach")
+		}
+		if params.ExpectStdoutRegex != "" && params.StdoutFile != "" {
+			return "", fmt.Errorf("expect_stdout_regex cannot be combined with stdout_file")
 		}
-	case float64:
-		return v != 0, true
-	case int:
-		return v != 0, true
 	}
-	return false, false
-}
-
-func parseInt(value interface{}) (int, bool) {
-	switch v := value.(type) {
-	case float64:
-		return int(v), true
-	case int:
-		return v, true
-	case int64:
-		return int(v), true
-	case string:
-		parsed, err := strconv.Atoi(v)
-		if err == nil {
-			return parsed, true
+	var expectStdout *regexp.Regexp
+	if params.ExpectStdoutRegex != "" {
+		re, err := regexp.Compile(params.ExpectStdoutRegex)
+		if err != nil {
+			return "", fmt.Errorf("invalid expect_stdout_regex: %w", err)
 		}
+		expectStdout = re
 	}
-	return 0, false
-}
 
-func loadLegacySettings(path string) (Settings, bool) {
-	data, err := os.ReadFile(path)
+	// Resolve the shell up front so an unsupported name fails loudly rather
+	// than silently falling back to the OS default. The configured
+	// default_shell applies when the call doesn't name one.
+	requestedShell := params.Shell
+	if requestedShell == "" {
+		requestedShell = fallbackShell(settings)
+	}
+	shell, err := resolveShell(requestedShell)
+	if params.ShellPath != "" {
+		shell, err = resolveShellPath(params.ShellPath)
+	}
+	if err == nil && len(params.Argv) == 0 {
+		err = checkShellAllowed(shell, settings.AllowedShells)
+	}
 	if err != nil {
-		return Settings{}, false
+		return "", err
 	}
 
-	var raw map[string]interface{}
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return Settings{}, false
+	// Sessions feed commands to a long-lived POSIX shell's stdin
+	if params.SessionID != "" {
+		if len(params.Argv) > 0 || params.Stdin != "" || params.Stream || params.TrackCwd || params.Retries > 0 || params.StdoutFile != "" || params.StderrFile != "" {
+			return "", fmt.Errorf("session_id cannot be combined with argv, stdin, stream, track_cwd, retries, stdout_file or stderr_file")
+		}
+		switch shell {
+		case "fish", "powershell", "pwsh", "cmd":
+			return "", fmt.Errorf("sessions are not supported for shell '%s'", shell)
+		}
 	}
 
-	settings := defaultSettings
-
-	if value, ok := raw["timeout_seconds"]; ok {
-		if parsed, ok := parseInt(value); ok && parsed > 0 {
-			settings.TimeoutSeconds = parsed
+	// Tracking the final directory relies on a shell exit hook
+	if params.TrackCwd {
+		switch {
+		case len(params.Argv) > 0:
+			return "", fmt.Errorf("track_cwd requires a shell and cannot be used with argv")
+		case shell == "powershell" || shell == "pwsh" || shell == "cmd":
+			return "", fmt.Errorf("track_cwd is not supported for shell '%s'", shell)
 		}
 	}
-	if value, ok := raw["default_working_dir"]; ok {
-		if parsed := parseStringList(value); len(parsed) > 0 {
-			settings.DefaultWorkingDir = parsed[0]
+
+	// An alias stands for its full command, which is what gets validated,
+	// run and recorded
+	command := params.Command
+	var alias string
+	if full, ok := settings.Aliases[command]; ok && command != "" {
+		alias, command = command, full
+	}
+
+	// Argv is validated as its space-joined form
+	argv := params.Argv
+	if len(argv) > 0 {
+		if argv[0] == "" {
+			return "", fmt.Errorf("argv[0] must name the program to run")
 		}
+		shell = ""
+		command = strings.Join(argv, " ")
 	}
-	if value, ok := raw["allowed_patterns"]; ok {
-		if parsed := parseStringList(value); len(parsed) > 0 {
-			settings.AllowedPatterns = parsed
+
+	// Load a script file as the command; it is validated like an inline one
+	var commandFile string
+	if params.CommandFile != "" {
+		if command != "" || params.Template != "" {
+			return "", fmt.Errorf("command_file is mutually exclusive with command, template and argv")
+		}
+		dir, err := t.resolveWorkingDir(params.WorkingDir, settings)
+		if err != nil {
+			return "", err
+		}
+		commandFile, command, err = readCommandFile(params.CommandFile, dir, settings.AllowedWorkingDirs)
+		if err != nil {
+			return "", err
 		}
 	}
-	if value, ok := raw["blocked_patterns"]; ok {
-		if parsed := parseStringList(value); len(parsed) > 0 {
-			settings.BlockedPatterns = parsed
+
+	// Render a named template into the command, escaping its arguments
+	if params.Template != "" {
+		if command != "" {
+			return "", fmt.Errorf("command and template are mutually exclusive")
+		}
+		rendered, err := renderCommandTemplate(settings.CommandTemplates, params.Template, params.TemplateArgs, shell)
+		if err != nil {
+			return "", err
 		}
+		command = rendered
 	}
-	if value, ok := raw["allow_shell_metacharacters"]; ok {
-		if parsed, ok := parseBool(value); ok {
-			settings.AllowShellMetacharacters = parsed
+	if command == "" {
+		return "", fmt.Errorf("command is required")
+	}
+	// Substitute the built-in variables first so the expanded command is what
+	// gets validated
+	if strings.Contains(command, "${") {
+		vars, err := t.builtinVariables(params.WorkingDir, settings)
+		if err != nil {
+			return "", err
+		}
+		if len(argv) > 0 {
+			argv = slices.Clone(argv)
+			for i, arg := range argv {
+				if argv[i], err = expandBuiltinVariables(arg, vars, ""); err != nil {
+					return "", err
+				}
+			}
+			command = strings.Join(argv, " ")
+		} else if command, err = expandBuiltinVariables(command, vars, shell); err != nil {
+			return "", err
 		}
 	}
+	// Oversized commands are rejected before any pattern matching runs on them
+	if settings.MaxCommandLength > 0 && len(command) > settings.MaxCommandLength {
+		err := fmt.Errorf("%w: %d bytes exceeds max_command_length of %d", ErrCommandTooLong, len(command), settings.MaxCommandLength)
+		rejections.record(err)
+		return "", err
+	}
+	// NULs and escape sequences can confuse the shell and corrupt the audit
+	// log and result JSON, so they never reach validation
+	if err := checkControlCharacters(command); err != nil {
+		rejections.record(err)
+		return "", err
+	}
 
-	return settings, true
-}
-
-// loadSettings loads settings from agent config or uses defaults.
-// Always reads fresh from disk to pick up configuration changes without server restart.
-func (t *ori_shell_executorTool) loadSettings() Settings {
-	settings := defaultSettings
+	// Per-invocation pattern lists replace (not merge with) the configured ones
+	if len(params.AllowedPatterns) > 0 {
+		settings.AllowedPatterns = params.AllowedPatterns
+		settings.AllowedSubcommands = nil
+	}
+	if len(params.BlockedPatterns) > 0 {
+		settings.BlockedPatterns = params.BlockedPatterns
+	}
+	// A per-invocation allow_shell_metacharacters overrides the setting: true
+	// skips the operator check, false enforces it, with allowed_metacharacters
+	// and blocked_metacharacters still applied
+	if params.AllowShellMetacharacters != nil {
+		settings.AllowShellMetacharacters = *params.AllowShellMetacharacters
+	}
 
-	// Build list of paths to try
-	var settingsPaths []string
+	// A trusted caller's token lifts the pattern lists; every other check
+	// (metacharacters, working dir, run_as) still applies
+	bypass, err := t.checkBypassToken(params.BypassToken)
+	if err != nil {
+		return "", err
+	}
+	if bypass {
+		settings.AllowedPatterns = nil
+		settings.AllowedSubcommands = nil
+		settings.BlockedPatterns = nil
+		settings.ConfirmPatterns = nil
+		fmt.Fprintf(os.Stderr, "ori-shell-executor: bypass token accepted, skipping pattern checks for: %s\n", command)
+	}
 
-	agentCtx := t.GetAgentContext()
-	if agentCtx.AgentDir != "" {
-		settingsPaths = append(settingsPaths, filepath.Join(agentCtx.AgentDir, "ori-shell-executor_settings.json"))
+	// Validate command against metacharacter, blocked and allowed rules
+	var matchedAllow string
+	var validationErr error
+	if len(params.Argv) > 0 {
+		matchedAllow, validationErr = t.validateArgv(command, settings)
+	} else {
+		matchedAllow, validationErr = t.validateCommand(command, shell, settings)
 	}
 
-	// Fallback paths if AgentDir is empty or file not found
-	settingsPaths = append(settingsPaths,
-		"agents/default/ori-shell-executor_settings.json",
-		"agents/plugin-test-agent/ori-shell-executor_settings.json",
-	)
+	// Determine working directory and timeout
+	workingDir, err := t.resolveWorkingDir(params.WorkingDir, settings)
+	if err != nil {
+		return "", err
+	}
+	timeout, timeoutClamped := resolveTimeout(params.TimeoutSeconds, settings)
+	// A call can make itself nicer than the setting, never less nice
+	nice := max(settings.Nice, params.Nice)
+	if validationErr == nil {
+		validationErr = validateWorkingDir(workingDir, settings.AllowedWorkingDirs)
+	}
+	if validationErr == nil {
+		validationErr = validateRunAs(settings.RunAsUID, settings.RunAsGID)
+	}
+	var umask *int
+	if validationErr == nil {
+		umask, validationErr = parseUmask(settings.Umask)
+	}
+	var stdoutFile, stderrFile string
+	if validationErr == nil && params.StdoutFile != "" {
+		stdoutFile, validationErr = resolveOutputFile("stdout_file", params.StdoutFile, workingDir, settings.AllowedWorkingDirs)
+	}
+	if validationErr == nil && params.StderrFile != "" {
+		stderrFile, validationErr = resolveOutputFile("stderr_file", params.StderrFile, workingDir, settings.AllowedWorkingDirs)
+	}
+	var createWorkingDir bool
+	if validationErr == nil {
+		createWorkingDir, validationErr = checkWorkingDir(workingDir, params.CreateWorkingDir)
+	}
 
-	// Try each path, reading fresh from disk
-	for _, path := range settingsPaths {
-		if loadedSettings, ok := loadLegacySettings(path); ok {
-			return loadedSettings
+	// Globs expand against the resolved directory; what they expand to must
+	// pass the pattern checks as well
+	if validationErr == nil && params.ExpandGlobs {
+		argv, validationErr = expandArgvGlobs(argv, workingDir, params.GlobNoMatch == globNoMatchError)
+		if validationErr == nil {
+			command = strings.Join(argv, " ")
+			matchedAllow, validationErr = t.validateArgv(command, settings)
 		}
 	}
 
-	return settings
-}
+	// Arguments that name files must stay inside allowed_path_roots; like the
+	// working directory check, a bypass token does not lift this
+	if validationErr == nil && len(settings.AllowedPathRoots) > 0 {
+		validationErr = checkPathArguments(command, argv, shell, workingDir, settings.AllowedPathRoots)
+	}
 
-// validateNotBlocked checks command against blocked patterns
-func (t *ori_shell_executorTool) validateNotBlocked(command string, blockedPatterns []string) error {
-	for _, pattern := range blockedPatterns {
-		if matchesPattern(command, pattern) {
-			return fmt.Errorf("command blocked by security policy: matches blocked pattern '%s'", pattern)
-		}
+	// Commands matching confirm_patterns only run once the caller confirms
+	var confirmPattern string
+	if validationErr == nil && !params.Confirmed {
+		confirmPattern, validationErr = t.confirmationPattern(command, shell, settings)
 	}
-	return nil
-}
 
-// validateShellMetacharacters blocks common shell operators unless explicitly allowed.
-func (t *ori_shell_executorTool) validateShellMetacharacters(command string, allow bool) error {
-	if allow {
-		return nil
+	// Commands matching advisory_patterns run as usual but carry warnings
+	var warnings []string
+	if validationErr == nil {
+		warnings, validationErr = advisoryWarnings(command, shell, settings)
 	}
 
-	if containsShellMetacharacters(command) {
-		return fmt.Errorf("command contains shell metacharacters; set allow_shell_metacharacters to true to override")
+	// In dry-run mode, report what would happen without running anything
+	if params.DryRun {
+		if validationErr == nil {
+			validationErr = checkProgramAvailable(settings.CommandPrefix, argv, shell, settings.PathOverride)
+		}
+		commandLine := buildCommandLine(settings.CommandPrefix, argv, shell, command)
+		return dryRunResult(command, argv, commandLine, params.Template, shell, workingDir, effectivePath(params.Env, settings.PathOverride), timeout, timeoutClamped, confirmPattern, validationErr)
+	}
+	if validationErr != nil {
+		rejections.record(validationErr)
+		record := newAuditRecord(command, workingDir, nil, validationErr)
+		record.Bypass = bypass
+		record.Agent = t.GetAgentContext().Name
+		record.CorrelationID = params.CorrelationID
+		record.Alias = alias
+		writeAuditLog(settings.AuditLogPath, record)
+		return "", validationErr
+	}
+	if confirmPattern != "" {
+		return confirmationResult(command, confirmPattern, settings.PatternReasons[confirmPattern])
+	}
+	if createWorkingDir {
+		if err := os.MkdirAll(workingDir, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create working directory: %w", err)
+		}
 	}
 
-	return nil
-}
+	outputEncoding, err := lookupOutputEncoding(settings.OutputEncoding)
+	if err != nil {
+		return "", err
+	}
+	redactions, err := compileRedactions(settings.RedactionPatterns)
+	if err != nil {
+		return "", err
+	}
 
-// validateAllowed checks command against allowed patterns
-func (t *ori_shell_executorTool) validateAllowed(command string, allowedPatterns []string) error {
-	// If no patterns specified, allow all (after blocked check)
-	if len(allowedPatterns) == 0 {
-		return nil
+	// Execute command
+	opts := execOptions{
+		Command:        command,
+		Argv:           argv,
+		WorkingDir:     workingDir,
+		TimeoutSeconds: timeout,
+		GraceSeconds:   settings.GraceSeconds,
+		Shell:          shell,
+		Env:            params.Env,
+		EnvAllowlist:   settings.EnvAllowlist,
+		EnvBlocklist:   settings.EnvBlocklist,
+		PathOverride:   settings.PathOverride,
+		Stdin:          params.Stdin,
+		Stream:         params.Stream,
+		TeeToConsole:   settings.TeeToConsole,
+		TrackCwd:       params.TrackCwd,
+		StdoutFile:     stdoutFile,
+		StderrFile:     stderrFile,
+		CombineOutput:  params.CombineOutput,
+		MaxOutputBytes: settings.MaxOutputBytes,
+		MaxStdoutBytes: settings.MaxStdoutBytes,
+		MaxStderrBytes: settings.MaxStderrBytes,
+		TruncateMode:   settings.TruncateMode,
+		MaxConcurrent:  settings.MaxConcurrent,
+		RunAsUID:       settings.RunAsUID,
+		RunAsGID:       settings.RunAsGID,
+		Umask:          umask,
+		Nice:           nice,
+		OutputEncoding: outputEncoding,
+		CommandPrefix:  settings.CommandPrefix,
+		Redactions:     redactions,
+	}
+	runID := params.RunID
+	if runID == "" {
+		runID = newRunID()
+	}
+	events := params.StreamFormat == streamFormatNDJSON
+	if events {
+		opts.StreamHandler = eventOutputHandler(t.handler(), runID)
 	}
 
-	for _, pattern := range allowedPatterns {
-		if matchesPattern(command, pattern) {
-			return nil
+	// A detached command is only started; status and cancel take its run_id
+	if params.Detach {
+		result, err := startDetached(runID, opts)
+		record := newAuditRecord(command, workingDir, nil, err)
+		record.Allowed = true
+		record.Pid, _ = result["pid"].(int)
+		record.Bypass = bypass
+		record.MatchedAllowPattern = matchedAllow
+		record.Agent = t.GetAgentContext().Name
+		record.CorrelationID = params.CorrelationID
+		record.Alias = alias
+		writeAuditLog(settings.AuditLogPath, record)
+		if err != nil {
+			return "", err
+		}
+		if params.CorrelationID != "" {
+			result["correlation_id"] = params.CorrelationID
 		}
+		if alias != "" {
+			result["alias"] = alias
+		}
+		if len(warnings) > 0 {
+			result["warnings"] = warnings
+		}
+		output, _ := json.MarshalIndent(result, "", "  ")
+		return string(output), nil
 	}
 
-	return fmt.Errorf("command not in allowed list. Allowed patterns: %v", allowedPatterns)
-}
-
-// expandTilde expands ~ to the user's home directory
-func expandTilde(path string) string {
-	if path == "~" {
-		if home, err := os.UserHomeDir(); err == nil {
-			return home
-		}
-		return path
+	// Register the run so the cancel action can stop it; in streaming mode the
+	// id is delivered first so the caller has it while the command runs
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	if err := activeRuns.register(runID, cancelRun); err != nil {
+		return "", err
 	}
-	if strings.HasPrefix(path, "~/") {
-		if home, err := os.UserHomeDir(); err == nil {
-			return filepath.Join(home, path[2:])
+	defer activeRuns.unregister(runID)
+	if events {
+		start := streamEvent{Type: eventTypeStart, RunID: runID, Command: command, WorkingDir: workingDir}
+		if len(argv) > 0 {
+			start.Argv = argv
+		} else {
+			start.Shell = shell
 		}
+		emitEvent(t.handler(), start)
+	} else if params.Stream {
+		t.handler()("run_id", runID)
 	}
-	return path
-}
 
-// executeCommand runs the shell command with timeout
-func (t *ori_shell_executorTool) executeCommand(ctx context.Context, command, workingDir string, timeoutSeconds int, shell string) (string, error) {
-	// Create context with timeout
-	execCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
-	defer cancel()
+	var result map[string]interface{}
+	if params.SessionID != "" {
+		result, err = executeInSession(runCtx, params.SessionID, opts, settings.SessionIdleTimeout)
+	} else {
+		result, err = t.executeWithRetries(runCtx, opts, params.Retries, params.RetryDelayMs, params.RetryExitCodes)
+	}
+	record := newAuditRecord(command, workingDir, result, err)
+	record.Bypass = bypass
+	record.MatchedAllowPattern = matchedAllow
+	record.Agent = t.GetAgentContext().Name
+	record.CorrelationID = params.CorrelationID
+	record.Alias = alias
+	writeAuditLog(settings.AuditLogPath, record)
+	if err != nil {
+		if events {
+			emitEvent(t.handler(), resultEvent(runID, nil, err))
+		}
+		return "", err
+	}
 
-	// Create command based on shell selection
-	var cmd *exec.Cmd
-	switch shell {
+	result["run_id"] = runID
+	if params.CorrelationID != "" {
+		result["correlation_id"] = params.CorrelationID
+	}
+	if matchedAllow != "" {
+		result["matched_allow_pattern"] = matchedAllow
+	}
+	result["status"] = resultStatus(result)
+	if events {
+		emitEvent(t.handler(), resultEvent(runID, result, nil))
+	}
+	if params.Verbose {
+		result["settings_source"] = source
+	}
+	if params.Template != "" {
+		result["template"] = params.Template
+	}
+	if alias != "" {
+		result["alias"] = alias
+	}
+	if commandFile != "" {
+		result["command_file"] = commandFile
+	}
+	if timeoutClamped {
+		result["timeout_seconds"] = timeout
+		result["timeout_clamped"] = true
+	}
+	if createWorkingDir {
+		result["created_working_dir"] = true
+	}
+	if len(warnings) > 0 {
+		result["warnings"] = warnings
+	}
+
+	// Expectations are checked against the output as captured
+	var unmet []string
+	if expectStdout != nil || params.ExpectExitCode != nil {
+		unmet = checkExpectations(result, expectStdout, params.ExpectExitCode)
+		result["expectation_met"] = len(unmet) == 0
+		if len(unmet) > 0 {
+			result["expectation_failures"] = unmet
+		}
+	}
+	if params.TrimOutput {
+		trimOutput(result)
+	}
+
+	// Text mode returns the bare output; the exit status travels in the error.
+	// An expected exit code stands in for zero.
+	if params.OutputFormat == outputFormatText {
+		text, err := textResult(result)
+		if params.ExpectExitCode != nil && errors.Is(err, ErrNonZeroExit) {
+			err = nil
+		}
+		if err == nil && len(unmet) > 0 {
+			err = fmt.Errorf("%w: %s", ErrExpectationFailed, strings.Join(unmet, "; "))
+		}
+		return text, err
+	}
+	if params.ParseStdoutJSON {
+		parseStdoutJSON(result)
+	}
+	if params.CompressOutput {
+		compressOutput(result)
+	}
+
+	// Return as JSON
+	output, _ := json.MarshalIndent(result, "", "  ")
+
+	// An unmet expectation is always an error, keeping the full result
+	if len(unmet) > 0 {
+		return string(output), fmt.Errorf("%w: %s: %s", ErrExpectationFailed, strings.Join(unmet, "; "), output)
+	}
+
+	// Optionally surface a non-zero exit as a Go error, keeping the full
+	// result; an expected exit code stands in for zero
+	if code := exitCode(result); params.FailOnNonzero && code != 0 && params.ExpectExitCode == nil {
+		if timedOut, _ := result["timed_out"].(bool); timedOut {
+			return string(output), fmt.Errorf("%w: %s", ErrTimeout, output)
+		}
+		return string(output), fmt.Errorf("%w: exited with code %d: %s", ErrNonZeroExit, code, output)
+	}
+	return string(output), nil
+}
+
+// checkExpectations compares result with the expected stdout and exit code,
+// either of which may be unset, and describes each one that was not met.
+// With combined output the regex is matched against the combined stream.
+func checkExpectations(result map[string]interface{}, expectStdout *regexp.Regexp, expectExitCode *int) []string {
+	var unmet []string
+	if expectExitCode != nil {
+		if code := exitCode(result); code != *expectExitCode {
+			unmet = append(unmet, fmt.Sprintf("exit code %d, expected %d", code, *expectExitCode))
+		}
+	}
+	if expectStdout != nil {
+		stdout, ok := result["stdout"].(string)
+		if !ok {
+			stdout, _ = result["combined"].(string)
+		}
+		if !expectStdout.MatchString(stdout) {
+			unmet = append(unmet, fmt.Sprintf("stdout does not match %q", expectStdout.String()))
+		}
+	}
+	return unmet
+}
+
+// checkBypassToken reports whether token matches the configured bypass token.
+// A token that is given but wrong is an error rather than a silent fallback to
+// normal enforcement, so misconfigured automation fails loudly.
+func (t *ori_shell_executorTool) checkBypassToken(token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	if t.bypassToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(t.bypassToken)) != 1 {
+		return false, fmt.Errorf("invalid bypass token")
+	}
+	return true, nil
+}
+
+// textResult returns the plain output of result: stdout on success, stderr
+// on failure, or the combined stream. A timeout or non-zero exit is returned
+// as an error alongside that output.
+func textResult(result map[string]interface{}) (string, error) {
+	code := exitCode(result)
+	text, ok := result["combined"].(string)
+	if !ok {
+		stream := "stdout"
+		if code != 0 {
+			stream = "stderr"
+		}
+		text, _ = result[stream].(string)
+	}
+
+	if timedOut, _ := result["timed_out"].(bool); timedOut {
+		return text, fmt.Errorf("%w: %v", ErrTimeout, result["error"])
+	}
+	if code != 0 {
+		return text, fmt.Errorf("%w: exited with code %d", ErrNonZeroExit, code)
+	}
+	return text, nil
+}
+
+// executeBatch runs params.Commands one after another, each through the full
+// validation and execution pipeline, and returns a JSON array with one result
+// per command. A rejected command is recorded in the array with its error
+// instead of aborting the batch, unless stop_on_error is set, which also
+// stops at the first non-zero exit.
+func (t *ori_shell_executorTool) executeBatch(ctx context.Context, params *OriShellExecutorParams) (string, error) {
+	results := make([]map[string]interface{}, 0, len(params.Commands))
+	failures := 0
+	for i, command := range params.Commands {
+		single := *params
+		single.Commands = nil
+		single.Command = command
+		single.FailOnNonzero = false
+		single.OutputFormat = outputFormatJSON
+		if params.RunID != "" {
+			single.RunID = fmt.Sprintf("%s-%d", params.RunID, i+1)
+		}
+
+		output, err := t.Execute(ctx, &single)
+		var item map[string]interface{}
+		if err != nil && !errors.Is(err, ErrExpectationFailed) {
+			item = map[string]interface{}{
+				"command":  command,
+				"rejected": true,
+				"status":   rejectionStatus(err),
+				"error":    err.Error(),
+			}
+		} else {
+			json.Unmarshal([]byte(output), &item)
+		}
+		results = append(results, item)
+
+		code, _ := item["exit_code"].(float64)
+		if err != nil || (code != 0 && params.ExpectExitCode == nil) {
+			failures++
+			if params.StopOnError {
+				break
+			}
+		}
+	}
+
+	output, _ := json.MarshalIndent(results, "", "  ")
+	if params.FailOnNonzero && failures > 0 {
+		return string(output), fmt.Errorf("%w: %d of %d commands failed: %s", ErrNonZeroExit, failures, len(results), output)
+	}
+	return string(output), nil
+}
+
+// trimOutput strips trailing newlines and spaces from the captured output
+// fields of result
+func trimOutput(result map[string]interface{}) {
+	for _, key := range []string{"stdout", "stderr", "combined"} {
+		if output, ok := result[key].(string); ok {
+			result[key] = strings.TrimRight(output, " \t\r\n")
+		}
+	}
+}
+
+// parseStdoutJSON replaces the stdout field of result with its parsed form
+// under stdout_json. If stdout is not valid JSON it is kept as is and
+// stdout_json is null with the reason in parse_error.
+func parseStdoutJSON(result map[string]interface{}) {
+	stdout, ok := result["stdout"].(string)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	decoder.UseNumber()
+	var parsed interface{}
+	err := decoder.Decode(&parsed)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after the first JSON value")
+	}
+	if err != nil {
+		result["stdout_json"] = nil
+		result["parse_error"] = err.Error()
+		return
+	}
+	delete(result, "stdout")
+	result["stdout_json"] = parsed
+}
+
+// compressOutput replaces the captured output fields of result with their
+// gzipped, base64-encoded form and marks the result as compressed
+func compressOutput(result map[string]interface{}) {
+	for _, key := range []string{"stdout", "stderr", "combined"} {
+		output, ok := result[key].(string)
+		if !ok {
+			continue
+		}
+		// Writes to a bytes.Buffer cannot fail
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(output))
+		zw.Close()
+		result[key] = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	result["compressed"] = true
+}
+
+// resultStatus classifies an execution result by its error_kind and
+// exit_code
+func resultStatus(result map[string]interface{}) string {
+	switch result["error_kind"] {
+	case errorKindTimeout:
+		return statusTimeout
+	case errorKindNotFound:
+		return statusNotFound
+	case errorKindCancelled:
+		return statusCancelled
+	case errorKindExecError:
+		return statusFailed
+	}
+	if code, _ := result["exit_code"].(int); code == 0 {
+		return statusSuccess
+	}
+	return statusFailed
+}
+
+// checkControlCharacters rejects command if it contains a NUL byte or any
+// other control character except tab, newline and carriage return
+func checkControlCharacters(command string) error {
+	for i, r := range command {
+		if r == '\t' || r == '\n' || r == '\r' {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %U at byte %d", ErrControlCharacter, r, i)
+		}
+	}
+	return nil
+}
+
+// rejectionStatus classifies an error that stopped a command before it ran:
+// policy rejections are blocked, anything else failed
+func rejectionStatus(err error) string {
+	if errors.Is(err, ErrBlockedPattern) || errors.Is(err, ErrNotAllowed) || errors.Is(err, ErrShellMetacharacters) || errors.Is(err, ErrCommandTooLong) || errors.Is(err, ErrControlCharacter) || errors.Is(err, ErrOutsidePathRoots) {
+		return statusBlocked
+	}
+	return statusFailed
+}
+
+// cancelRun cancels the running command registered under runID. Its process
+// group is killed and the execute call returns with error_kind "cancelled".
+func cancelRun(runID string) (string, error) {
+	if runID == "" {
+		return "", fmt.Errorf("run_id is required for the cancel action")
+	}
+	if !activeRuns.cancel(runID) {
+		return "", fmt.Errorf("no running command with run_id '%s'", runID)
+	}
+
+	result := map[string]interface{}{
+		"action":    actionCancel,
+		"run_id":    runID,
+		"cancelled": true,
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// settingsResult reports the effective settings and where they came from
+func (t *ori_shell_executorTool) settingsResult(settings Settings, source settingsSource) (string, error) {
+	result := map[string]interface{}{
+		"action":          actionGetSettings,
+		"settings":        settings,
+		"settings_path":   source.Path,
+		"settings_source": source,
+		"using_defaults":  source.Path == "",
+		"searched_paths":  t.settingsPaths(),
+	}
+	if warnings := shadowedAllowedPatterns(settings); len(warnings) > 0 {
+		result["warnings"] = warnings
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// effectivePatternsResult reports the allowed and blocked patterns a call
+// with params would be checked against, labelling where each one came from
+func (t *ori_shell_executorTool) effectivePatternsResult(params *OriShellExecutorParams) (string, error) {
+	fileSettings, source := t.loadFileSettings()
+	settingsPath := source.Path
+	settings := fileSettings
+	if settingsPath != "" {
+		settings = t.mergePatternFiles(fileSettings)
+	}
+
+	result := map[string]interface{}{
+		"action":            actionGetEffectivePatterns,
+		"settings_path":     settingsPath,
+		"enforce_allowlist": settings.EnforceAllowlist,
+		"allowed_patterns":  labelPatterns(settings.AllowedPatterns, fileSettings.AllowedPatterns, defaultSettings.AllowedPatterns, params.AllowedPatterns, settingsPath, settings.PatternReasons),
+		"blocked_patterns":  labelPatterns(settings.BlockedPatterns, fileSettings.BlockedPatterns, defaultSettings.BlockedPatterns, params.BlockedPatterns, settingsPath, settings.PatternReasons),
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// testPatternResult reports which of commands match pattern, matched the way
+// validation matches allowed and blocked patterns under settings
+func testPatternResult(pattern string, commands []string, settings Settings) (string, error) {
+	if pattern == "" {
+		return "", fmt.Errorf("pattern is required for the test_pattern action")
+	}
+	if len(commands) == 0 {
+		return "", fmt.Errorf("commands is required for the test_pattern action")
+	}
+
+	expanded := expandPatternsEnv([]string{pattern}, settings.PatternSyntax)[0]
+	matcher := newPatternMatcher(settings)
+	matched := []string{}
+	unmatched := []string{}
+	for _, command := range commands {
+		hit, err := matchingPattern(command, []string{expanded}, matcher)
+		if err != nil {
+			return "", err
+		}
+		if hit != "" {
+			matched = append(matched, command)
+		} else {
+			unmatched = append(unmatched, command)
+		}
+	}
+
+	result := map[string]interface{}{
+		"action":         actionTestPattern,
+		"pattern":        pattern,
+		"pattern_syntax": settings.PatternSyntax,
+		"matched":        matched,
+		"unmatched":      unmatched,
+	}
+	if expanded != pattern {
+		result["expanded_pattern"] = expanded
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// labelPatterns lists the patterns in force for one list with their source.
+// A per-call list replaces everything else. Otherwise merged is the inline
+// list followed by the pattern file's entries; inline entries are defaults
+// while the list still starts with the built-in one, i.e. the settings file
+// left it alone or only extended it for the platform.
+func labelPatterns(merged, inline, defaults, param []string, settingsPath string, reasons map[string]string) []map[string]string {
+	patterns := merged
+	if len(param) > 0 {
+		patterns = param
+	}
+	inheritsDefaults := len(param) == 0 && (settingsPath == "" ||
+		len(inline) >= len(defaults) && slices.Equal(inline[:len(defaults)], defaults))
+
+	labelled := make([]map[string]string, 0, len(patterns))
+	for i, pattern := range patterns {
+		source := patternSourceSettings
+		switch {
+		case len(param) > 0:
+			source = patternSourceParam
+		case i >= len(inline):
+			source = patternSourceFile
+		case inheritsDefaults && i < len(defaults):
+			source = patternSourceDefault
+		}
+		entry := map[string]string{"pattern": pattern, "source": source}
+		if reason := reasons[pattern]; reason != "" && len(param) == 0 {
+			entry["reason"] = reason
+		}
+		labelled = append(labelled, entry)
+	}
+	return labelled
+}
+
+// builtinVariableNames are the ${NAME} references the executor substitutes in
+// commands before validation
+var builtinVariableNames = []string{"AGENT_DIR", "WORKING_DIR", "TIMESTAMP"}
+
+// builtinVariables returns the values of the built-in variables for a call
+// with the given working_dir parameter. TIMESTAMP is the current UTC time in
+// a form that is safe in file names.
+func (t *ori_shell_executorTool) builtinVariables(workingDir string, settings Settings) (map[string]string, error) {
+	dir, err := t.resolveWorkingDir(workingDir, settings)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"AGENT_DIR":   t.GetAgentContext().AgentDir,
+		"WORKING_DIR": dir,
+		"TIMESTAMP":   time.Now().UTC().Format("20060102T150405Z"),
+	}, nil
+}
+
+// expandBuiltinVariables replaces each built-in variable reference in s with
+// its value, shell-quoted for shell unless shell is empty (argv). Other ${...}
+// references are left for the shell. A variable without a value is an error,
+// so a command like "rm -r ${AGENT_DIR}/tmp" never runs against "/tmp".
+func expandBuiltinVariables(s string, vars map[string]string, shell string) (string, error) {
+	for _, name := range builtinVariableNames {
+		ref := "${" + name + "}"
+		if !strings.Contains(s, ref) {
+			continue
+		}
+		value := vars[name]
+		if value == "" {
+			return "", fmt.Errorf("%s is not available in this context", ref)
+		}
+		if shell != "" {
+			quoted, err := quoteShellArg(shell, value)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", ref, err)
+			}
+			value = quoted
+		}
+		s = strings.ReplaceAll(s, ref, value)
+	}
+	return s, nil
+}
+
+// renderCommandTemplate renders the named template from templates using
+// text/template. Each argument is shell-quoted for shell before substitution
+// so argument values cannot inject operators into the command.
+func renderCommandTemplate(templates map[string]string, name string, args map[string]string, shell string) (string, error) {
+	text, ok := templates[name]
+	if !ok {
+		return "", fmt.Errorf("unknown command template '%s'", name)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid command template '%s': %w", name, err)
+	}
+
+	quoted := make(map[string]string, len(args))
+	for key, value := range args {
+		q, err := quoteShellArg(shell, value)
+		if err != nil {
+			return "", fmt.Errorf("template argument '%s': %w", key, err)
+		}
+		quoted[key] = q
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, quoted); err != nil {
+		return "", fmt.Errorf("failed to render command template '%s': %w", name, err)
+	}
+	return rendered.String(), nil
+}
+
+// fishQuoteEscaper escapes a value for use inside fish single quotes
+var fishQuoteEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteShellArg quotes value as a single literal argument for shell
+func quoteShellArg(shell, value string) (string, error) {
+	switch shell {
+	case "powershell", "pwsh":
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'", nil
+	case "fish":
+		// fish reads \' and \\ as escapes inside single quotes
+		return "'" + fishQuoteEscaper.Replace(value) + "'", nil
+	case "cmd":
+		// cmd.exe has no reliable escape for these inside double quotes
+		if strings.ContainsAny(value, "\"%!\r\n") {
+			return "", fmt.Errorf("value contains characters that cannot be safely quoted for cmd")
+		}
+		return `"` + value + `"`, nil
+	default:
+		return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'", nil
+	}
+}
+
+// maxRetries bounds the retries a single call may request
+const maxRetries = 10
+
+// maxNice is the lowest scheduling priority a command can be given
+const maxNice = 19
+
+// executeWithRetries runs the command, re-running it up to retries times while
+// it exits non-zero or times out; a non-empty retryExitCodes limits retries to
+// those codes (-1 for a timeout or a command that could not be started). The
+// delay doubles after each failed attempt. The final attempt's result is
+// returned with an "attempts" count.
+func (t *ori_shell_executorTool) executeWithRetries(ctx context.Context, opts execOptions, retries, retryDelayMs int, retryExitCodes []int) (map[string]interface{}, error) {
+	if retries < 0 {
+		retries = 0
+	}
+	if retries > maxRetries {
+		retries = maxRetries
+	}
+	delay := time.Duration(retryDelayMs) * time.Millisecond
+
+	attempts := 0
+	for {
+		attempts++
+		result, err := t.executeCommand(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		code := exitCode(result)
+		retryable := code != 0 && (len(retryExitCodes) == 0 || slices.Contains(retryExitCodes, code))
+		if !retryable || attempts > retries || !sleepContext(ctx, delay) {
+			result["attempts"] = attempts
+			return result, nil
+		}
+		delay *= 2
+	}
+}
+
+// exitCode returns the exit_code recorded in a command result
+func exitCode(result map[string]interface{}) int {
+	code, _ := result["exit_code"].(int)
+	return code
+}
+
+// sleepContext waits for d, returning false if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// validateCommand runs the metacharacter, blocked and allowed checks in order
+// and returns the allowed pattern that let the command through, if any
+func (t *ori_shell_executorTool) validateCommand(command, shell string, settings Settings) (string, error) {
+	// Reject shell metacharacters unless explicitly allowed
+	if err := t.validateShellMetacharacters(command, shell, settings.AllowShellMetacharacters, settings.AllowedMetacharacters, settings.BlockedMetacharacters); err != nil {
+		return "", err
+	}
+
+	// Validate command against blocked patterns
+	chained := len(findShellMetacharacters(command, shell, shellOperators)) > 0
+	if err := t.validateNotBlocked(command, settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)); err != nil {
+		if chained {
+			// Note allowed conflicts for the piece that is blocked, not for
+			// a harmless command chained in front of it
+			return "", t.noteSegmentAllowedConflict(err, command, shell, settings)
+		}
+		return "", t.noteAllowedConflict(err, command, settings)
+	}
+
+	// Operators that got past the metacharacter check chain sub-commands; check
+	// each one so a dangerous command can't hide behind a benign prefix
+	if chained {
+		for _, segment := range splitShellCommand(command, shell) {
+			if err := t.validateNotBlocked(segment, settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)); err != nil {
+				return "", t.noteAllowedConflict(err, segment, settings)
+			}
+		}
+		for _, r := range commandRedirections(command, shell) {
+			if err := t.validateNotBlocked(r.String(), settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)); err != nil {
+				return "", fmt.Errorf("%w (redirection '%s')", err, r)
+			}
+		}
+	}
+
+	// Check every line of a multi-line script on its own as well, quoted or
+	// not, so a command on line 5 of an inline script or here-doc is caught
+	if strings.Contains(command, "\n") {
+		for _, line := range commandLines(command) {
+			if err := t.validateNotBlocked(line, settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)); err != nil {
+				return "", fmt.Errorf("%w (line '%s')", t.noteAllowedConflict(err, line, settings), line)
+			}
+		}
+	}
+
+	// In deny-list-only mode anything not blocked may run
+	if !settings.EnforceAllowlist {
+		return "", nil
+	}
+
+	// Validate against allowed patterns each simple command on its own, so an
+	// allowed prefix like "echo *" can't carry a chained or substituted
+	// command along with it
+	segments := []string{command}
+	if chained {
+		if parsed := commandSegments(command, shell); len(parsed) > 0 {
+			segments = parsed
+		}
+	}
+	var matchedAllow string
+	for _, segment := range segments {
+		rule, err := t.validateAllowed(segment, settings.AllowedPatterns, settings.AllowedSubcommands, newPatternMatcher(settings))
+		if err != nil {
+			if segment != command {
+				return "", fmt.Errorf("%w (sub-command '%s')", err, segment)
+			}
+			return "", err
+		}
+		if matchedAllow == "" {
+			matchedAllow = rule
+		}
+	}
+
+	// A redirection writes or reads a file the sub-command patterns never
+	// see, so it needs an allowed pattern of its own, e.g. "> /tmp/*"
+	if chained {
+		for _, r := range commandRedirections(command, shell) {
+			if _, err := t.validateAllowed(r.String(), settings.AllowedPatterns, settings.AllowedSubcommands, newPatternMatcher(settings)); err != nil {
+				return "", fmt.Errorf("%w (redirection '%s')", err, r)
+			}
+		}
+	}
+	return matchedAllow, nil
+}
+
+// validateArgv runs the blocked and allowed checks on the joined form of an
+// argv invocation. There is no shell to chain or redirect, so metacharacters
+// in arguments are plain data.
+func (t *ori_shell_executorTool) validateArgv(command string, settings Settings) (string, error) {
+	if err := t.validateNotBlocked(command, settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)); err != nil {
+		return "", t.noteAllowedConflict(err, command, settings)
+	}
+	if !settings.EnforceAllowlist {
+		return "", nil
+	}
+	return t.validateAllowed(command, settings.AllowedPatterns, settings.AllowedSubcommands, newPatternMatcher(settings))
+}
+
+// expandArgvGlobs expands glob arguments of argv against dir. argv[0] is
+// never expanded. A relative glob yields relative paths and an absolute one
+// absolute paths. A glob matching nothing is kept literally, or is an error
+// when failNoMatch is set.
+func expandArgvGlobs(argv []string, dir string, failNoMatch bool) ([]string, error) {
+	expanded := []string{argv[0]}
+	for _, arg := range argv[1:] {
+		if !strings.ContainsAny(arg, "*?[") {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		pattern := arg
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob '%s': %w", arg, err)
+		}
+		if len(matches) == 0 {
+			if failNoMatch {
+				return nil, fmt.Errorf("glob '%s' matched no files in %s", arg, dir)
+			}
+			expanded = append(expanded, arg)
+			continue
+		}
+		for _, match := range matches {
+			if !filepath.IsAbs(arg) {
+				if rel, err := filepath.Rel(dir, match); err == nil {
+					match = rel
+				}
+			}
+			expanded = append(expanded, match)
+		}
+	}
+	return expanded, nil
+}
+
+// confirmationPattern returns the confirm pattern that command, or any
+// sub-command chained in it, matches, or "" if the command needs no
+// confirmation
+func (t *ori_shell_executorTool) confirmationPattern(command, shell string, settings Settings) (string, error) {
+	if len(settings.ConfirmPatterns) == 0 {
+		return "", nil
+	}
+	matcher := newPatternMatcher(settings)
+	pattern, err := matchingPattern(command, settings.ConfirmPatterns, matcher)
+	if err != nil || pattern != "" || shell == "" {
+		return pattern, err
+	}
+	if len(findShellMetacharacters(command, shell, shellOperators)) > 0 {
+		for _, segment := range splitShellCommand(command, shell) {
+			if pattern, err := matchingPattern(segment, settings.ConfirmPatterns, matcher); err != nil || pattern != "" {
+				return pattern, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// advisoryWarnings returns a warning for each advisory pattern that command,
+// or a sub-command chained in it, matches: the pattern's reason, or a note
+// naming the pattern when it has none
+func advisoryWarnings(command, shell string, settings Settings) ([]string, error) {
+	if len(settings.AdvisoryPatterns) == 0 {
+		return nil, nil
+	}
+	candidates := []string{command}
+	if shell != "" && len(findShellMetacharacters(command, shell, shellOperators)) > 0 {
+		candidates = append(candidates, splitShellCommand(command, shell)...)
+	}
+
+	matcher := newPatternMatcher(settings)
+	var warnings []string
+	for _, pattern := range settings.AdvisoryPatterns {
+		for _, candidate := range candidates {
+			matched, err := matchingPattern(candidate, []string{pattern}, matcher)
+			if err != nil {
+				return nil, err
+			}
+			if matched == "" {
+				continue
+			}
+			if reason := settings.PatternReasons[pattern]; reason != "" {
+				warnings = append(warnings, reason)
+			} else {
+				warnings = append(warnings, fmt.Sprintf("matches advisory pattern '%s'", pattern))
+			}
+			break
+		}
+	}
+	return warnings, nil
+}
+
+// confirmationResult reports that command was held back because it matches
+// confirmPattern; the caller re-submits it with confirmed: true once approved
+func confirmationResult(command, confirmPattern, reason string) (string, error) {
+	result := map[string]interface{}{
+		"command":            command,
+		"status":             statusNeedsConfirmation,
+		"needs_confirmation": true,
+		"confirm_pattern":    confirmPattern,
+		"message":            fmt.Sprintf("command matches confirm pattern '%s' and was not run; re-submit it with confirmed: true once approved", confirmPattern),
+	}
+	if reason != "" {
+		result["reason"] = reason
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// maxCommandFileBytes is the largest script command_file may load
+const maxCommandFileBytes = 1 << 20
+
+// readCommandFile loads the script at path, resolved against workingDir when
+// relative, and returns its absolute path and trimmed contents. The file must
+// lie inside allowedDirs when any are configured.
+func readCommandFile(path, workingDir string, allowedDirs []string) (string, string, error) {
+	path = expandPath(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+	if err := validateWorkingDir(filepath.Dir(path), allowedDirs); err != nil {
+		return "", "", fmt.Errorf("command_file '%s' is outside the allowed working directories: %v", path, allowedDirs)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read command_file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("command_file '%s' is not a regular file", path)
+	}
+	if info.Size() > maxCommandFileBytes {
+		return "", "", fmt.Errorf("command_file '%s' is %d bytes, larger than the %d byte limit", path, info.Size(), maxCommandFileBytes)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read command_file: %w", err)
+	}
+	return path, strings.TrimSpace(string(data)), nil
+}
+
+// resolveOutputFile resolves path, the value of the param stdout_file or
+// stderr_file, against workingDir and checks that it is inside allowedDirs
+func resolveOutputFile(param, path, workingDir string, allowedDirs []string) (string, error) {
+	path = expandPath(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+	if err := validateWorkingDir(filepath.Dir(path), allowedDirs); err != nil {
+		return "", fmt.Errorf("%s '%s' is outside the allowed working directories: %v", param, path, allowedDirs)
+	}
+	return path, nil
+}
+
+// resolveWorkingDir determines the working directory: params > settings > agent context > cwd
+func (t *ori_shell_executorTool) resolveWorkingDir(workingDir string, settings Settings) (string, error) {
+	if workingDir != "" {
+		return expandPath(workingDir), nil
+	}
+	if settings.DefaultWorkingDir != "" {
+		return expandPath(settings.DefaultWorkingDir), nil
+	}
+
+	agentCtx := t.GetAgentContext()
+	if agentCtx.AgentDir != "" {
+		return agentCtx.AgentDir, nil
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+	return workingDir, nil
+}
+
+// validateWorkingDir ensures workingDir is inside one of allowedDirs.
+// An empty allowedDirs list permits any directory.
+func validateWorkingDir(workingDir string, allowedDirs []string) error {
+	if len(allowedDirs) == 0 {
+		return nil
+	}
+
+	dir, err := normalizeDir(workingDir)
+	if err != nil {
+		return fmt.Errorf("invalid working directory '%s': %w", workingDir, err)
+	}
+	for _, allowed := range allowedDirs {
+		root, err := normalizeDir(allowed)
+		if err != nil {
+			continue
+		}
+		if isWithinDir(dir, root) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("working directory '%s' is outside the allowed working directories: %v", workingDir, allowedDirs)
+}
+
+// normalizeDir expands ~, makes path absolute and resolves symlinks in the
+// longest existing prefix of the path, so a link cannot be used to escape an
+// allowed root even by a directory that is yet to be created
+func normalizeDir(path string) (string, error) {
+	abs, err := filepath.Abs(expandPath(path))
+	if err != nil {
+		return "", err
+	}
+
+	existing, rest := abs, ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(existing); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// checkWorkingDir stats dir up front so a missing directory gets a clear
+// error instead of a chdir failure from exec. With create set, a missing
+// directory is accepted and reported as needing to be created.
+func checkWorkingDir(dir string, create bool) (bool, error) {
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil && !info.IsDir():
+		return false, fmt.Errorf("working directory is not a directory: %s", dir)
+	case err == nil:
+		return false, nil
+	case errors.Is(err, fs.ErrNotExist) && create:
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, fmt.Errorf("working directory does not exist: %s", dir)
+	default:
+		return false, fmt.Errorf("cannot access working directory %s: %w", dir, err)
+	}
+}
+
+// isWithinDir reports whether path equals root or is nested inside it
+func isWithinDir(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// validateRunAs rejects negative run_as_uid/run_as_gid values
+func validateRunAs(uid, gid *int) error {
+	if uid != nil && *uid < 0 {
+		return fmt.Errorf("invalid run_as_uid %d: must not be negative", *uid)
+	}
+	if gid != nil && *gid < 0 {
+		return fmt.Errorf("invalid run_as_gid %d: must not be negative", *gid)
+	}
+	return nil
+}
+
+// parseUmask parses an octal umask such as "022". An empty string means the
+// agent's umask is inherited and yields nil.
+func parseUmask(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || parsed > 0o777 {
+		return nil, fmt.Errorf("invalid umask '%s': must be an octal value from 000 to 777", value)
+	}
+	umask := int(parsed)
+	return &umask, nil
+}
+
+// resolveTimeout determines the timeout in seconds: params > settings > 60,
+// capped at max_timeout_seconds (300 when unset). It reports whether the
+// requested timeout was clamped so the cap is never silent.
+func resolveTimeout(timeout int, settings Settings) (int, bool) {
+	if timeout <= 0 {
+		timeout = settings.TimeoutSeconds
+	}
+	if timeout <= 0 {
+		timeout = 60
+	}
+	maxTimeout := settings.MaxTimeoutSeconds
+	if maxTimeout <= 0 {
+		maxTimeout = 300
+	}
+	if timeout > maxTimeout {
+		return maxTimeout, true
+	}
+	return timeout, false
+}
+
+// dryRunResult describes what Execute would do without running the command
+func dryRunResult(command string, argv, commandLine []string, templateName, shell, workingDir, path string, timeoutSeconds int, timeoutClamped bool, confirmPattern string, validationErr error) (string, error) {
+	result := map[string]interface{}{
+		"dry_run":         true,
+		"would_execute":   validationErr == nil,
+		"command":         command,
+		"command_line":    commandLine,
+		"working_dir":     workingDir,
+		"path":            path,
+		"timeout_seconds": timeoutSeconds,
+	}
+	if len(argv) > 0 {
+		result["argv"] = argv
+	} else {
+		result["shell"] = shell
+	}
+	if templateName != "" {
+		result["template"] = templateName
+	}
+	if timeoutClamped {
+		result["timeout_clamped"] = true
+	}
+	if confirmPattern != "" {
+		result["needs_confirmation"] = true
+		result["confirm_pattern"] = confirmPattern
+	}
+	if validationErr != nil {
+		result["reason"] = validationErr.Error()
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// parseLines splits a newline-separated string into a slice, trimming whitespace
+func parseLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// platformPatternSuffix names the platform pattern lists that apply here:
+// allowed_patterns_windows on Windows, allowed_patterns_unix everywhere else
+func platformPatternSuffix() string {
+	if runtime.GOOS == "windows" {
+		return "windows"
+	}
+	return "unix"
+}
+
+// parsePatternList parses a pattern list like parseStringList. When trim is
+// false, leading and trailing whitespace is kept so patterns match exactly as
+// written; only empty entries and Windows line endings are dropped. Array
+// entries may also be {"pattern": ..., "reason": ...} objects, see
+// collectPatternReasons.
+func parsePatternList(value interface{}, trim bool) []string {
+	if items, ok := value.([]interface{}); ok {
+		patterns := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			if object, ok := item.(map[string]interface{}); ok {
+				item = object["pattern"]
+			}
+			patterns = append(patterns, item)
+		}
+		value = patterns
+	}
+	if trim {
+		return parseStringList(value)
+	}
+
+	var items []string
+	switch v := value.(type) {
+	case string:
+		items = strings.Split(v, "\n")
+	case []string:
+		items = v
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+	}
+
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSuffix(item, "\r")
+		if strings.TrimSpace(item) != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// collectPatternReasons adds the reason of every {"pattern": ..., "reason":
+// ...} entry in a pattern list to reasons, keyed by the pattern as
+// parsePatternList returns it, and returns the (possibly new) map
+func collectPatternReasons(value interface{}, trim bool, reasons map[string]string) map[string]string {
+	items, _ := value.([]interface{})
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pattern, _ := object["pattern"].(string)
+		reason, _ := object["reason"].(string)
+		if trim {
+			pattern = strings.TrimSpace(pattern)
+		}
+		reason = strings.TrimSpace(reason)
+		if strings.TrimSpace(pattern) == "" || reason == "" {
+			continue
+		}
+		if reasons == nil {
+			reasons = make(map[string]string)
+		}
+		reasons[pattern] = reason
+	}
+	return reasons
+}
+
+func parseStringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return parseLines(v)
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				s = strings.TrimSpace(s)
+				if s != "" {
+					result = append(result, s)
+				}
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// parseStringMap accepts a JSON object of strings or newline-separated
+// "key=value" lines
+func parseStringMap(value interface{}) map[string]string {
+	result := make(map[string]string)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if s, ok := item.(string); ok && key != "" {
+				result[key] = s
+			}
+		}
+	case string:
+		for _, line := range parseLines(v) {
+			key, val, ok := strings.Cut(line, "=")
+			if key = strings.TrimSpace(key); ok && key != "" {
+				result[key] = strings.TrimSpace(val)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// parseSubcommandTree accepts a JSON object mapping each program to a list of
+// subcommand patterns, or lines of "program: pattern, pattern"
+func parseSubcommandTree(value interface{}) map[string][]string {
+	result := make(map[string][]string)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for program, item := range v {
+			patterns := parseStringList(item)
+			if s, ok := item.(string); ok {
+				patterns = splitCommaList(s)
+			}
+			if program = strings.TrimSpace(program); program != "" && len(patterns) > 0 {
+				result[program] = patterns
+			}
+		}
+	case string:
+		for _, line := range parseLines(v) {
+			program, list, ok := strings.Cut(line, ":")
+			if program = strings.TrimSpace(program); ok && program != "" {
+				if patterns := splitCommaList(list); len(patterns) > 0 {
+					result[program] = append(result[program], patterns...)
+				}
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// splitCommaList splits a comma-separated list, trimming and dropping empty items
+func splitCommaList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func parseBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err == nil {
+			return parsed, true
+		}
+	case float64:
+		return v != 0, true
+	case int:
+		return v != 0, true
+	}
+	return false, false
+}
+
+func parseInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case string:
+		parsed, err := strconv.Atoi(v)
+		if err == nil {
+			return parsed, true
+		}
+	}
+	return 0, false
+}
+
+func loadLegacySettings(path string) (Settings, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Settings{}, false
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Settings{}, false
+	}
+
+	settings := defaultSettings
+
+	if value, ok := raw["timeout_seconds"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed > 0 {
+			settings.TimeoutSeconds = parsed
+		}
+	}
+	if value, ok := raw["max_timeout_seconds"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed > 0 {
+			settings.MaxTimeoutSeconds = parsed
+		}
+	}
+	if value, ok := raw["grace_seconds"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.GraceSeconds = parsed
+		}
+	}
+	if value, ok := raw["max_command_length"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.MaxCommandLength = parsed
+		}
+	}
+	if value, ok := raw["default_working_dir"]; ok {
+		if parsed := parseStringList(value); len(parsed) > 0 {
+			settings.DefaultWorkingDir = parsed[0]
+		}
+	}
+	if value, ok := raw["default_shell"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.DefaultShell = strings.ToLower(strings.TrimSpace(parsed))
+		}
+	}
+	if value, ok := raw["allowed_shells"]; ok {
+		settings.AllowedShells = parseAllowedShells(value)
+	}
+	if value, ok := raw["disabled"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.Disabled = parsed
+		}
+	}
+	// trim_patterns must be read before the pattern lists it applies to
+	if value, ok := raw["trim_patterns"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.TrimPatterns = parsed
+		}
+	}
+	if value, ok := raw["allowed_patterns"]; ok {
+		if parsed := parsePatternList(value, settings.TrimPatterns); len(parsed) > 0 {
+			settings.AllowedPatterns = parsed
+		}
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	if value, ok := raw["blocked_patterns"]; ok {
+		if parsed := parsePatternList(value, settings.TrimPatterns); len(parsed) > 0 {
+			settings.BlockedPatterns = parsed
+		}
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	// Platform lists extend the base lists on the matching OS only
+	if value, ok := raw["allowed_patterns_"+platformPatternSuffix()]; ok {
+		settings.AllowedPatterns = append(slices.Clone(settings.AllowedPatterns), parsePatternList(value, settings.TrimPatterns)...)
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	if value, ok := raw["blocked_patterns_"+platformPatternSuffix()]; ok {
+		settings.BlockedPatterns = append(slices.Clone(settings.BlockedPatterns), parsePatternList(value, settings.TrimPatterns)...)
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	if value, ok := raw["confirm_patterns"]; ok {
+		settings.ConfirmPatterns = parsePatternList(value, settings.TrimPatterns)
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	if value, ok := raw["advisory_patterns"]; ok {
+		settings.AdvisoryPatterns = parsePatternList(value, settings.TrimPatterns)
+		settings.PatternReasons = collectPatternReasons(value, settings.TrimPatterns, settings.PatternReasons)
+	}
+	if value, ok := raw["allowed_subcommands"]; ok {
+		settings.AllowedSubcommands = parseSubcommandTree(value)
+	}
+	if value, ok := raw["program_aliases"]; ok {
+		settings.ProgramAliases = parseSubcommandTree(value)
+	}
+	if value, ok := raw["allowed_patterns_file"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.AllowedPatternsFile = strings.TrimSpace(parsed)
+		}
+	}
+	if value, ok := raw["blocked_patterns_file"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.BlockedPatternsFile = strings.TrimSpace(parsed)
+		}
+	}
+	if value, ok := raw["enforce_allowlist"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.EnforceAllowlist = parsed
+		}
+	}
+	if value, ok := raw["allow_shell_metacharacters"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.AllowShellMetacharacters = parsed
+		}
+	}
+	if value, ok := raw["pattern_syntax"]; ok {
+		if parsed, ok := value.(string); ok {
+			switch syntax := strings.ToLower(strings.TrimSpace(parsed)); syntax {
+			case patternSyntaxGlob, patternSyntaxRegex, patternSyntaxPath:
+				settings.PatternSyntax = syntax
+			}
+		}
+	}
+	if value, ok := raw["case_insensitive_matching"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.CaseInsensitiveMatching = parsed
+		}
+	}
+	if value, ok := raw["max_output_bytes"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.MaxOutputBytes = parsed
+		}
+	}
+	if value, ok := raw["max_stdout_bytes"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.MaxStdoutBytes = parsed
+		}
+	}
+	if value, ok := raw["max_stderr_bytes"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.MaxStderrBytes = parsed
+		}
+	}
+	if value, ok := raw["truncate_mode"]; ok {
+		if parsed, ok := value.(string); ok {
+			switch mode := strings.ToLower(strings.TrimSpace(parsed)); mode {
+			case truncateModeHead, truncateModeTail, truncateModeBoth:
+				settings.TruncateMode = mode
+			}
+		}
+	}
+	if value, ok := raw["allowed_metacharacters"]; ok {
+		settings.AllowedMetacharacters = parseMetacharacters(value)
+	}
+	if value, ok := raw["blocked_metacharacters"]; ok {
+		settings.BlockedMetacharacters = parseMetacharacters(value)
+	}
+	if value, ok := raw["allowed_working_dirs"]; ok {
+		settings.AllowedWorkingDirs = parseStringList(value)
+	}
+	if value, ok := raw["allowed_path_roots"]; ok {
+		settings.AllowedPathRoots = parseStringList(value)
+	}
+	if value, ok := raw["output_encoding"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.OutputEncoding = strings.TrimSpace(parsed)
+		}
+	}
+	if value, ok := raw["audit_log_path"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.AuditLogPath = strings.TrimSpace(parsed)
+		}
+	}
+	if value, ok := raw["tee_to_console"]; ok {
+		if parsed, ok := parseBool(value); ok {
+			settings.TeeToConsole = parsed
+		}
+	}
+	if value, ok := raw["command_templates"]; ok {
+		settings.CommandTemplates = parseStringMap(value)
+	}
+	if value, ok := raw["aliases"]; ok {
+		settings.Aliases = parseStringMap(value)
+	}
+	if value, ok := raw["max_concurrent"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 {
+			settings.MaxConcurrent = parsed
+		}
+	}
+	// Negative ids are kept so validateRunAs can reject them loudly
+	if value, ok := raw["run_as_uid"]; ok {
+		if parsed, ok := parseInt(value); ok {
+			settings.RunAsUID = &parsed
+		}
+	}
+	if value, ok := raw["run_as_gid"]; ok {
+		if parsed, ok := parseInt(value); ok {
+			settings.RunAsGID = &parsed
+		}
+	}
+	if value, ok := raw["nice"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed >= 0 && parsed <= maxNice {
+			settings.Nice = parsed
+		}
+	}
+	if value, ok := raw["umask"]; ok {
+		if parsed, ok := value.(string); ok {
+			settings.Umask = strings.TrimSpace(parsed)
+		}
+	}
+	if value, ok := raw["session_idle_timeout_seconds"]; ok {
+		if parsed, ok := parseInt(value); ok && parsed > 0 {
+			settings.SessionIdleTimeout = parsed
+		}
+	}
+	if value, ok := raw["command_prefix"]; ok {
+		settings.CommandPrefix = parseStringList(value)
+	}
+	if value, ok := raw["redaction_patterns"]; ok {
+		settings.RedactionPatterns = parseStringList(value)
+	}
+	if value, ok := raw["env_allowlist"]; ok {
+		settings.EnvAllowlist = parseStringList(value)
+	}
+	if value, ok := raw["env_blocklist"]; ok {
+		settings.EnvBlocklist = parseStringList(value)
+	}
+	if value, ok := raw["path_override"]; ok {
+		settings.PathOverride = parseStringList(value)
+	}
+
+	// Environment references are expanded once the syntax is known
+	settings = expandSettingsEnv(settings)
+
+	for _, warning := range shadowedAllowedPatterns(settings) {
+		fmt.Fprintf(os.Stderr, "ori-shell-executor: %s: %s\n", path, warning)
+	}
+
+	return settings, true
+}
+
+// settingsSource describes where a call's settings came from, reported so a
+// settings edit that seems to have no effect can be traced
+type settingsSource struct {
+	Path       string `json:"path"`                  // "" when the defaults are in use
+	CacheHit   bool   `json:"cache_hit"`             // parsed on an earlier call, unchanged since
+	ModifiedAt string `json:"modified_at,omitempty"` // the file's modification time
+}
+
+// settingsCacheEntry holds parsed settings and the file state they were read from
+type settingsCacheEntry struct {
+	settings Settings
+	modTime  time.Time
+	size     int64
+}
+
+var (
+	settingsCacheMu sync.Mutex
+	settingsCache   = make(map[string]settingsCacheEntry)
+)
+
+// loadCachedSettings returns the settings at path, re-reading and re-parsing
+// the file only when its modification time or size has changed.
+func loadCachedSettings(path string) (Settings, settingsSource, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Settings{}, settingsSource{}, false
+	}
+	source := settingsSource{Path: path, ModifiedAt: info.ModTime().UTC().Format(time.RFC3339Nano)}
+
+	settingsCacheMu.Lock()
+	entry, ok := settingsCache[path]
+	settingsCacheMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		source.CacheHit = true
+		return entry.settings, source, true
+	}
+
+	settings, ok := loadLegacySettings(path)
+
+	settingsCacheMu.Lock()
+	defer settingsCacheMu.Unlock()
+	if !ok {
+		delete(settingsCache, path)
+		return Settings{}, settingsSource{}, false
+	}
+	settingsCache[path] = settingsCacheEntry{settings: settings, modTime: info.ModTime(), size: info.Size()}
+	return settings, source, true
+}
+
+// loadSettings loads settings from agent config or uses defaults.
+// The file is checked on every call, so configuration changes are picked up
+// without a server restart, but it is only re-parsed when it has changed.
+func (t *ori_shell_executorTool) loadSettings() Settings {
+	settings, _ := t.loadSettingsWithSource()
+	return settings
+}
+
+// loadSettingsWithSource is loadSettings, also returning where the settings
+// were read from; the source's path is "" when the defaults are in use.
+func (t *ori_shell_executorTool) loadSettingsWithSource() (Settings, settingsSource) {
+	settings, source := t.loadFileSettings()
+	if source.Path == "" {
+		return settings, source
+	}
+	return t.mergePatternFiles(settings), source
+}
+
+// loadFileSettings returns the settings from the first settings file found,
+// without the pattern files merged in, and their source; or the defaults
+func (t *ori_shell_executorTool) loadFileSettings() (Settings, settingsSource) {
+	// Try each path, re-reading any file that changed on disk
+	for _, path := range t.settingsPaths() {
+		if loadedSettings, source, ok := loadCachedSettings(path); ok {
+			return loadedSettings, source
+		}
+	}
+
+	return defaultSettings, settingsSource{}
+}
+
+// settingsPaths lists the candidate settings files in priority order
+func (t *ori_shell_executorTool) settingsPaths() []string {
+	var settingsPaths []string
+
+	agentCtx := t.GetAgentContext()
+	if agentCtx.AgentDir != "" {
+		settingsPaths = append(settingsPaths, filepath.Join(agentCtx.AgentDir, "ori-shell-executor_settings.json"))
+	}
+
+	// Fallback paths if AgentDir is empty or file not found
+	settingsPaths = append(settingsPaths,
+		"agents/default/ori-shell-executor_settings.json",
+		"agents/plugin-test-agent/ori-shell-executor_settings.json",
+	)
+	return settingsPaths
+}
+
+// mergePatternFiles appends the patterns listed in the configured pattern
+// files to the inline lists. The files are read on every call so edits take
+// effect immediately; an unreadable file is reported and skipped.
+func (t *ori_shell_executorTool) mergePatternFiles(settings Settings) Settings {
+	if settings.AllowedPatternsFile != "" {
+		if patterns, err := t.readPatternFile(settings.AllowedPatternsFile, settings.TrimPatterns); err != nil {
+			fmt.Fprintf(os.Stderr, "ori-shell-executor: failed to read allowed_patterns_file: %v\n", err)
+		} else {
+			settings.AllowedPatterns = slices.Concat(settings.AllowedPatterns, expandPatternsEnv(patterns, settings.PatternSyntax))
+		}
+	}
+	if settings.BlockedPatternsFile != "" {
+		if patterns, err := t.readPatternFile(settings.BlockedPatternsFile, settings.TrimPatterns); err != nil {
+			fmt.Fprintf(os.Stderr, "ori-shell-executor: failed to read blocked_patterns_file: %v\n", err)
+		} else {
+			settings.BlockedPatterns = slices.Concat(settings.BlockedPatterns, expandPatternsEnv(patterns, settings.PatternSyntax))
+		}
+	}
+	return settings
+}
+
+// envReference matches a ${NAME} environment reference in a pattern
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandPatternsEnv returns patterns with each ${NAME} replaced by the value
+// of the environment variable NAME, or by nothing if it is undefined. With
+// regex and path syntax the value is escaped so it matches literally. A bare
+// $NAME is left alone, since $ anchors regex patterns.
+func expandPatternsEnv(patterns []string, syntax string) []string {
+	expanded := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		expanded[i] = envReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+			value := os.Getenv(envReference.FindStringSubmatch(ref)[1])
+			switch syntax {
+			case patternSyntaxRegex:
+				value = regexp.QuoteMeta(value)
+			case patternSyntaxPath:
+				value = pathPatternEscaper.Replace(value)
+			}
+			return value
+		})
+	}
+	return expanded
+}
+
+// pathPatternEscaper escapes the characters that are special to path.Match
+var pathPatternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// expandSettingsEnv expands environment references in the pattern lists of
+// settings, and in the keys of its pattern reasons so they still line up
+func expandSettingsEnv(settings Settings) Settings {
+	settings.AllowedPatterns = expandPatternsEnv(settings.AllowedPatterns, settings.PatternSyntax)
+	settings.BlockedPatterns = expandPatternsEnv(settings.BlockedPatterns, settings.PatternSyntax)
+	settings.ConfirmPatterns = expandPatternsEnv(settings.ConfirmPatterns, settings.PatternSyntax)
+	settings.AdvisoryPatterns = expandPatternsEnv(settings.AdvisoryPatterns, settings.PatternSyntax)
+	if len(settings.PatternReasons) > 0 {
+		reasons := make(map[string]string, len(settings.PatternReasons))
+		for pattern, reason := range settings.PatternReasons {
+			reasons[expandPatternsEnv([]string{pattern}, settings.PatternSyntax)[0]] = reason
+		}
+		settings.PatternReasons = reasons
+	}
+	return settings
+}
+
+// readPatternFile reads newline-delimited patterns from path, resolving a
+// relative path against the agent directory
+func (t *ori_shell_executorTool) readPatternFile(path string, trim bool) ([]string, error) {
+	path = expandPath(path)
+	if agentDir := t.GetAgentContext().AgentDir; !filepath.IsAbs(path) && agentDir != "" {
+		path = filepath.Join(agentDir, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePatternList(string(data), trim), nil
+}
+
+// validateNotBlocked checks command against blocked patterns. Runs of spaces
+// and tabs are collapsed first, in glob patterns too, so "rm   -rf  /" cannot
+// slip past "rm -rf /*". Regex patterns see both the original and the
+// collapsed command.
+func (t *ori_shell_executorTool) validateNotBlocked(command string, blockedPatterns []string, reasons map[string]string, matcher patternMatcher) error {
+	pattern, err := matchingPattern(command, blockedPatterns, matcher)
+	if err != nil || pattern == "" {
+		return err
+	}
+	if reason := reasons[pattern]; reason != "" {
+		return fmt.Errorf("%w: %s (matches blocked pattern '%s')", ErrBlockedPattern, reason, pattern)
+	}
+	return fmt.Errorf("%w: matches blocked pattern '%s'", ErrBlockedPattern, pattern)
+}
+
+// matchingPattern returns the first of patterns that command matches, or ""
+// if none does, collapsing whitespace as described at validateNotBlocked.
+// Program aliases are applied, see patternMatcher.forms.
+func matchingPattern(command string, patterns []string, matcher patternMatcher) (string, error) {
+	for _, form := range matcher.forms(command) {
+		if pattern, err := matchingPatternDirect(form, patterns, matcher); err != nil || pattern != "" {
+			return pattern, err
+		}
+	}
+	return "", nil
+}
+
+// matchingPatternDirect is matchingPattern for one form of a command
+func matchingPatternDirect(command string, patterns []string, matcher patternMatcher) (string, error) {
+	normalized := collapseWhitespace(command)
+	for _, pattern := range patterns {
+		var matched bool
+		var err error
+		if matcher.syntax == patternSyntaxRegex {
+			matched, err = matcher.match(command, pattern)
+			if err == nil && !matched && normalized != command {
+				matched, err = matcher.match(normalized, pattern)
+			}
+		} else {
+			matched, err = matcher.match(normalized, collapseWhitespace(pattern))
+		}
+		if err != nil {
+			return "", err
+		}
+		if matched {
+			return pattern, nil
+		}
+	}
+	return "", nil
+}
+
+// collapseWhitespace replaces each run of spaces and tabs with a single space
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inSpace := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inSpace {
+				b.WriteByte(' ')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// validateShellMetacharacters blocks common shell operators unless explicitly allowed,
+// either entirely via allow or individually via allowedOperators. A non-empty
+// blockedOperators replaces the built-in shellOperators list.
+func (t *ori_shell_executorTool) validateShellMetacharacters(command, shell string, allow bool, allowedOperators, blockedOperators []string) error {
+	if allow {
+		return nil
+	}
+
+	operators := shellOperators
+	if len(blockedOperators) > 0 {
+		operators = sortOperators(blockedOperators)
+	}
+	for _, op := range findShellMetacharacters(command, shell, operators) {
+		if !slices.Contains(allowedOperators, op) {
+			return fmt.Errorf("%w %q; set allow_shell_metacharacters to true or add it to allowed_metacharacters to override", ErrShellMetacharacters, op)
+		}
+	}
+
+	return nil
+}
+
+// validateAllowed checks command against allowed patterns and the
+// subcommand tree. A tree entry such as {"git": ["status", "diff *"]} allows
+// a command whose program is git and whose remaining arguments match one of
+// the nested patterns. It returns the rule that matched, see
+// matchingAllowedRule, or "" when there are no allowed rules at all.
+func (t *ori_shell_executorTool) validateAllowed(command string, allowedPatterns []string, subcommands map[string][]string, matcher patternMatcher) (string, error) {
+	// If no patterns specified, allow all (after blocked check)
+	if len(allowedPatterns) == 0 && len(subcommands) == 0 {
+		return "", nil
+	}
+
+	rule, err := matchingAllowedRule(command, allowedPatterns, subcommands, matcher)
+	if err != nil {
+		return "", err
+	}
+	if rule != "" {
+		return rule, nil
+	}
+
+	if len(subcommands) > 0 {
+		return "", fmt.Errorf("%w. Allowed patterns: %v, allowed subcommands: %v", ErrNotAllowed, allowedPatterns, subcommands)
+	}
+	return "", fmt.Errorf("%w. Allowed patterns: %v", ErrNotAllowed, allowedPatterns)
+}
+
+// matchingAllowedRule returns the first allowed pattern that command matches,
+// or for a subcommand entry "program: pattern", or "" if it matches none.
+// Program aliases are applied, see patternMatcher.forms.
+func matchingAllowedRule(command string, allowedPatterns []string, subcommands map[string][]string, matcher patternMatcher) (string, error) {
+	for _, form := range matcher.forms(command) {
+		if rule, err := matchingAllowedRuleDirect(form, allowedPatterns, subcommands, matcher); err != nil || rule != "" {
+			return rule, err
+		}
+	}
+	return "", nil
+}
+
+// matchingAllowedRuleDirect is matchingAllowedRule for one form of a command
+func matchingAllowedRuleDirect(command string, allowedPatterns []string, subcommands map[string][]string, matcher patternMatcher) (string, error) {
+	for _, pattern := range allowedPatterns {
+		matched, err := matcher.match(command, pattern)
+		if err != nil {
+			return "", err
+		}
+		if matched {
+			return pattern, nil
+		}
+	}
+
+	if program, args, ok := splitProgram(command); ok {
+		for name, patterns := range subcommands {
+			if name != program && !(matcher.caseInsensitive && strings.EqualFold(name, program)) {
+				continue
+			}
+			for _, pattern := range patterns {
+				matched, err := matcher.match(args, pattern)
+				if err != nil {
+					return "", err
+				}
+				if matched {
+					return name + ": " + pattern, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// noteSegmentAllowedConflict notes an allowed conflict, as noteAllowedConflict
+// does, for the first piece of the chained command that is blocked on its
+// own. When no single piece is blocked err is returned unchanged.
+func (t *ori_shell_executorTool) noteSegmentAllowedConflict(err error, command, shell string, settings Settings) error {
+	for _, segment := range splitShellCommand(command, shell) {
+		if t.validateNotBlocked(segment, settings.BlockedPatterns, settings.PatternReasons, newPatternMatcher(settings)) != nil {
+			return t.noteAllowedConflict(err, segment, settings)
+		}
+	}
+	return err
+}
+
+// noteAllowedConflict extends a blocked-pattern error for command when the
+// command also matches an allowed rule, so overlapping rules are visible.
+// Blocked patterns always win; only the message changes.
+func (t *ori_shell_executorTool) noteAllowedConflict(err error, command string, settings Settings) error {
+	if !errors.Is(err, ErrBlockedPattern) {
+		return err
+	}
+	if len(settings.AllowedPatterns) == 0 && len(settings.AllowedSubcommands) == 0 {
+		return err
+	}
+	rule, matchErr := matchingAllowedRule(command, settings.AllowedPatterns, settings.AllowedSubcommands, newPatternMatcher(settings))
+	if matchErr != nil || rule == "" {
+		return err
+	}
+	return fmt.Errorf("%w (it also matches allowed pattern '%s'; blocked patterns take precedence)", err, rule)
+}
+
+// shadowedAllowedPatterns returns a warning for each allowed pattern that a
+// blocked pattern rejects in full, making the allowed entry dead. For glob
+// syntax a pattern is shadowed when a blocked glob matches its text with the
+// wildcards taken literally, which is sufficient since a blocked * can then
+// absorb whatever the allowed * would; regex and path patterns are only
+// compared for equality, since a path ? or class cannot absorb a *.
+func shadowedAllowedPatterns(settings Settings) []string {
+	matcher := newPatternMatcher(settings)
+	var warnings []string
+	for _, allowed := range settings.AllowedPatterns {
+		for _, blocked := range settings.BlockedPatterns {
+			if allowed == blocked || (matcher.syntax == patternSyntaxGlob && globShadows(allowed, blocked, matcher)) {
+				warnings = append(warnings, fmt.Sprintf("allowed pattern '%s' is shadowed by blocked pattern '%s' and never matches", allowed, blocked))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// globShadows reports whether every command matching the glob allowed also
+// matches the glob blocked
+func globShadows(allowed, blocked string, matcher patternMatcher) bool {
+	// "prog:git" allows "git" with any arguments, as "git *" does
+	if program, ok := strings.CutPrefix(allowed, programPatternPrefix); ok {
+		allowed = strings.TrimSpace(program) + " *"
+	}
+	allowed = collapseWhitespace(allowed)
+	blocked = collapseWhitespace(blocked)
+	if matcher.requireArgs && strings.HasSuffix(allowed, " ") {
+		// An untrimmed "ls " allows what "ls *" does, bar plain "ls"
+		matched, _ := matcher.match(allowed+"*", blocked)
+		return matched
+	}
+	if matched, _ := matcher.match(allowed, blocked); !matched {
+		return false
+	}
+	// "ls *" also allows plain "ls"
+	if base, ok := strings.CutSuffix(allowed, " *"); ok {
+		matched, _ := matcher.match(base, blocked)
+		return matched
+	}
+	return true
+}
+
+// splitProgram splits command into its first word and the trimmed rest
+func splitProgram(command string) (string, string, bool) {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return "", "", false
+	}
+	end := strings.IndexAny(command, " \t")
+	if end < 0 {
+		return command, "", true
+	}
+	return command[:end], strings.TrimSpace(command[end:]), true
+}
+
+// expandTilde expands ~ to the user's home directory
+func expandTilde(path string) string {
+	if path == "~" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home
+		}
+		return path
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// expandPath expands a leading ~ and then $VAR / ${VAR} references.
+// As with os.ExpandEnv, undefined variables expand to empty strings.
+func expandPath(path string) string {
+	return os.ExpandEnv(expandTilde(path))
+}
+
+// commandEnv builds the environment for a command: the inherited variables
+// filtered by opts' allow and block lists, with the per-command overrides
+// applied on top. Overrides are explicit, so the lists don't filter them, but
+// a path override replaces PATH even if the overrides set it. A nil result
+// inherits everything unchanged.
+func commandEnv(overrides map[string]string, opts execOptions) []string {
+	if len(overrides) == 0 && len(opts.EnvAllowlist) == 0 && len(opts.EnvBlocklist) == 0 && len(opts.PathOverride) == 0 {
+		return nil
+	}
+	if len(opts.PathOverride) > 0 {
+		overrides = maps.Clone(overrides)
+		if overrides == nil {
+			overrides = make(map[string]string)
+		}
+		for key := range overrides {
+			if key == "PATH" || (runtime.GOOS == "windows" && strings.EqualFold(key, "PATH")) {
+				delete(overrides, key)
+			}
+		}
+		overrides["PATH"] = strings.Join(opts.PathOverride, string(os.PathListSeparator))
+	}
+	return mergeEnv(filterEnv(os.Environ(), opts.EnvAllowlist, opts.EnvBlocklist), overrides)
+}
+
+// effectivePath returns the PATH a command will see: the path override if
+// set, else a PATH among the per-command overrides, else the inherited one
+func effectivePath(overrides map[string]string, pathOverride []string) string {
+	if len(pathOverride) > 0 {
+		return strings.Join(pathOverride, string(os.PathListSeparator))
+	}
+	if path, ok := lookupEnvKey(overrides, "PATH"); ok {
+		return path
+	}
+	return os.Getenv("PATH")
+}
+
+// filterEnv keeps the KEY=VALUE entries whose name matches allow (all of
+// them if allow is empty) and none of block
+func filterEnv(environ, allow, block []string) []string {
+	filtered := make([]string, 0, len(environ))
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if len(allow) > 0 && !matchesEnvName(name, allow) {
+			continue
+		}
+		if matchesEnvName(name, block) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// matchesEnvName reports whether the variable name matches one of patterns,
+// each an exact name or a glob like AWS_*. Case is ignored on Windows.
+func matchesEnvName(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if runtime.GOOS == "windows" {
+			if globMatch(strings.ToUpper(pattern), strings.ToUpper(name)) {
+				return true
+			}
+		} else if globMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeEnv applies overrides on top of a KEY=VALUE environment slice.
+// Overridden keys are dropped from base so the override value wins.
+func mergeEnv(base []string, overrides map[string]string) []string {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	merged := make([]string, 0, len(base)+len(keys))
+	for _, entry := range base {
+		name, _, _ := strings.Cut(entry, "=")
+		if _, ok := lookupEnvKey(overrides, name); ok {
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	for _, key := range keys {
+		merged = append(merged, key+"="+overrides[key])
+	}
+	return merged
+}
+
+// lookupEnvKey finds name in overrides, ignoring case on Windows where
+// environment variable names are case-insensitive.
+func lookupEnvKey(overrides map[string]string, name string) (string, bool) {
+	if value, ok := overrides[name]; ok {
+		return value, true
+	}
+	if runtime.GOOS == "windows" {
+		for key, value := range overrides {
+			if strings.EqualFold(key, name) {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// defaultOutputHandler forwards streamed lines to the plugin's stderr, which
+// the plugin host relays to its log in real time.
+func defaultOutputHandler(stream, line string) {
+	// Events are written bare so the log holds a clean NDJSON transcript
+	if stream == eventStream {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%s] %s\n", stream, line)
+}
+
+// handler returns the configured OutputHandler or defaultOutputHandler
+func (t *ori_shell_executorTool) handler() OutputHandler {
+	if t.outputHandler == nil {
+		return defaultOutputHandler
+	}
+	return t.outputHandler
+}
+
+// redactedText replaces output matching a redaction pattern
+const redactedText = "***REDACTED***"
+
+// compileRedactions compiles the configured redaction regexes, rejecting
+// invalid ones so a typo can't silently let secrets through
+func compileRedactions(patterns []string) ([]*regexp.Regexp, error) {
+	redactions := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern '%s': %w", pattern, err)
+		}
+		redactions = append(redactions, re)
+	}
+	return redactions, nil
+}
+
+// redactingHandler wraps handler so streamed lines are redacted before they
+// are delivered. Matches are applied per line.
+func redactingHandler(handler OutputHandler, redactions []*regexp.Regexp) OutputHandler {
+	if len(redactions) == 0 {
+		return handler
+	}
+	return func(stream, line string) {
+		for _, re := range redactions {
+			line = re.ReplaceAllString(line, redactedText)
+		}
+		handler(stream, line)
+	}
+}
+
+// lineWriter splits written bytes into lines and hands each complete line to
+// an OutputHandler. Call Flush after the command exits to emit a trailing
+// line that has no newline.
+type lineWriter struct {
+	stream  string
+	handler OutputHandler
+	pending []byte
+}
+
+func newLineWriter(stream string, handler OutputHandler) *lineWriter {
+	return &lineWriter{stream: stream, handler: handler}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(w.pending[:idx]), "\r")
+		w.handler(w.stream, line)
+		w.pending = w.pending[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits any buffered partial line
+func (w *lineWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.handler(w.stream, string(w.pending))
+		w.pending = nil
+	}
+}
+
+// cappedBuffer stores at most limit bytes and counts the rest, so oversized
+// output is truncated while it is captured rather than after. A limit of 0
+// means unlimited. The mode chooses which bytes survive: the first limit
+// (head), the last limit (tail), or half of each (both).
+type cappedBuffer struct {
+	head    bytes.Buffer
+	tail    []byte
+	limit   int
+	mode    string
+	dropped int
+}
+
+// Supported values for Settings.TruncateMode
+const (
+	truncateModeHead = "head"
+	truncateModeTail = "tail"
+	truncateModeBoth = "both"
+)
+
+// streamLimits returns the capture limits for stdout and stderr when they
+// are kept apart: the per-stream limit where one is set, else MaxOutputBytes
+func (o execOptions) streamLimits() (stdout, stderr int) {
+	stdout, stderr = o.MaxOutputBytes, o.MaxOutputBytes
+	if o.MaxStdoutBytes > 0 {
+		stdout = o.MaxStdoutBytes
+	}
+	if o.MaxStderrBytes > 0 {
+		stderr = o.MaxStderrBytes
+	}
+	return stdout, stderr
+}
+
+func newCappedBuffer(limit int, mode string) *cappedBuffer {
+	return &cappedBuffer{limit: limit, mode: mode}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit <= 0 {
+		b.head.Write(p)
+		return n, nil
+	}
+
+	headLimit := b.limit
+	switch b.mode {
+	case truncateModeTail:
+		headLimit = 0
+	case truncateModeBoth:
+		headLimit = b.limit / 2
+	}
+
+	// Fill the head first, then keep a sliding window of the newest bytes
+	if room := headLimit - b.head.Len(); room > 0 {
+		k := min(room, len(p))
+		b.head.Write(p[:k])
+		p = p[k:]
+	}
+	tailLimit := b.limit - headLimit
+	if tailLimit == 0 {
+		b.dropped += len(p)
+		return n, nil
+	}
+	b.tail = append(b.tail, p...)
+	if excess := len(b.tail) - tailLimit; excess > 0 {
+		b.dropped += excess
+		b.tail = b.tail[excess:]
+	}
+	return n, nil
+}
+
+// Truncated reports whether any output was discarded
+func (b *cappedBuffer) Truncated() bool {
+	return b.dropped > 0
+}
+
+// Decode converts the captured bytes to UTF-8 using enc
+func (b *cappedBuffer) Decode(enc encoding.Encoding) error {
+	decoded, err := enc.NewDecoder().Bytes(b.head.Bytes())
+	if err != nil {
+		return err
+	}
+	b.head.Reset()
+	b.head.Write(decoded)
+
+	if len(b.tail) > 0 {
+		decoded, err = enc.NewDecoder().Bytes(b.tail)
+		if err != nil {
+			return err
+		}
+		b.tail = decoded
+	}
+	return nil
+}
+
+// Redact replaces every match of the given expressions with redactedText
+// and returns the number of replacements
+func (b *cappedBuffer) Redact(redactions []*regexp.Regexp) int {
+	count := 0
+	redact := func(data []byte) []byte {
+		for _, re := range redactions {
+			data = re.ReplaceAllFunc(data, func([]byte) []byte {
+				count++
+				return []byte(redactedText)
+			})
+		}
+		return data
+	}
+
+	head := redact(b.head.Bytes())
+	b.tail = redact(b.tail)
+	if count > 0 {
+		b.head.Reset()
+		b.head.Write(head)
+	}
+	return count
+}
+
+// String returns the captured output with a truncation marker where bytes
+// were dropped
+func (b *cappedBuffer) String() string {
+	if b.dropped == 0 {
+		return b.head.String() + string(b.tail)
+	}
+	marker := fmt.Sprintf("...[truncated %d bytes]", b.dropped)
+	switch b.mode {
+	case truncateModeTail:
+		return marker + string(b.tail)
+	case truncateModeBoth:
+		return b.head.String() + marker + "..." + string(b.tail)
+	default:
+		return b.head.String() + marker
+	}
+}
+
+// resolveShell returns the concrete shell for the requested name,
+// auto-detecting by OS when it is empty
+func resolveShell(shell string) (string, error) {
+	switch shell {
+	case "powershell", "pwsh", "cmd", "bash", "zsh", "fish", "sh":
+		return shell, nil
+	case "":
+		if runtime.GOOS == "windows" {
+			return "cmd", nil
+		}
+		return "sh", nil
+	}
+	return "", fmt.Errorf("unsupported shell '%s': use sh, bash, zsh, fish, powershell or cmd", shell)
+}
+
+// fallbackShell returns the shell for a call that names none: default_shell
+// if configured, else the OS default unless allowed_shells excludes it, in
+// which case the first allowed shell
+func fallbackShell(settings Settings) string {
+	if settings.DefaultShell != "" || len(settings.AllowedShells) == 0 {
+		return settings.DefaultShell
+	}
+	if osDefault, _ := resolveShell(""); slices.Contains(settings.AllowedShells, osDefault) {
+		return ""
+	}
+	return settings.AllowedShells[0]
+}
+
+// checkShellAllowed rejects shell unless allowed is empty or lists it. A
+// shell_path must be listed by its absolute path.
+func checkShellAllowed(shell string, allowed []string) error {
+	if len(allowed) == 0 || slices.Contains(allowed, shell) {
+		return nil
+	}
+	return fmt.Errorf("shell '%s' is not allowed: allowed_shells is %s", shell, strings.Join(allowed, ", "))
+}
+
+// parseAllowedShells reads the allowed_shells setting. Shell names are
+// lowercased like default_shell; absolute paths are kept as written.
+func parseAllowedShells(value interface{}) []string {
+	shells := parseStringList(value)
+	for i, shell := range shells {
+		if !filepath.IsAbs(shell) {
+			shells[i] = strings.ToLower(shell)
+		}
+	}
+	return shells
+}
+
+// resolveShellPath validates a custom shell binary given by absolute path.
+// The binary is invoked with -c like the POSIX shells.
+func resolveShellPath(path string) (string, error) {
+	path = expandPath(path)
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("shell_path '%s' must be an absolute path", path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("shell_path '%s' not found: %w", path, err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("shell_path '%s' is a directory", path)
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		return "", fmt.Errorf("shell_path '%s' is not executable", path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// checkShellAvailable verifies the binary for shell can be found on PATH, or
+// in pathOverride if set
+func checkShellAvailable(shell string, pathOverride []string) error {
+	name, _ := shellCommandLine(shell, "")
+	if _, err := lookPath(name, pathOverride); err != nil {
+		return fmt.Errorf("shell '%s' not found on PATH", name)
+	}
+	return nil
+}
+
+// checkProgramAvailable verifies the program that will run can be found: the
+// wrapper from prefix if set, else argv[0], else the shell binary
+func checkProgramAvailable(prefix, argv []string, shell string, pathOverride []string) error {
+	program := ""
+	switch {
+	case len(prefix) > 0:
+		program = prefix[0]
+	case len(argv) > 0:
+		program = argv[0]
+	default:
+		return checkShellAvailable(shell, pathOverride)
+	}
+	if _, err := lookPath(program, pathOverride); err != nil {
+		return fmt.Errorf("program '%s' not found: %w", program, err)
+	}
+	return nil
+}
+
+// lookPath finds the executable name like exec.LookPath, but searches only
+// the directories in pathOverride when it is set. Names containing a path
+// separator are used as they are.
+func lookPath(name string, pathOverride []string) (string, error) {
+	if len(pathOverride) == 0 || strings.ContainsAny(name, `/\`) {
+		return exec.LookPath(name)
+	}
+
+	candidates := []string{name}
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		candidates = []string{name + ".com", name + ".exe", name + ".bat", name + ".cmd"}
+	}
+	for _, dir := range pathOverride {
+		for _, candidate := range candidates {
+			path := filepath.Join(dir, candidate)
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if runtime.GOOS != "windows" && info.Mode().Perm()&0o111 == 0 {
+				continue
+			}
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// applyPathOverride resolves program, the first word of cmd's command line,
+// in pathOverride instead of the agent's PATH. exec.Command has already
+// looked it up on PATH, so both the path and any lookup error are replaced.
+func applyPathOverride(cmd *exec.Cmd, program string, pathOverride []string) {
+	if len(pathOverride) == 0 || strings.ContainsAny(program, `/\`) {
+		return
+	}
+	if path, err := lookPath(program, pathOverride); err != nil {
+		cmd.Err = err
+	} else {
+		cmd.Path, cmd.Err = path, nil
+	}
+}
+
+// buildCommandLine returns the full argv that is executed: the configured
+// prefix followed by either argv itself or the shell invocation of command.
+// A wrapper such as firejail then runs e.g. `firejail sh -c "<command>"`.
+func buildCommandLine(prefix, argv []string, shell, command string) []string {
+	if len(argv) == 0 {
+		name, args := shellCommandLine(shell, command)
+		argv = append([]string{name}, args...)
+	}
+	return slices.Concat(prefix, argv)
+}
+
+// trackCwdEnv names the variable holding the file the final directory is written to
+const trackCwdEnv = "ORI_SHELL_CWD_FILE"
+
+// trackCwdScript wraps command so the shell writes its final directory to the
+// file named by trackCwdEnv when it exits, keeping the command's exit status.
+// Only POSIX-style shells and fish are supported.
+func trackCwdScript(shell, command string) string {
+	if shell == "fish" {
+		return "function __ori_track_cwd --on-event fish_exit\n  pwd > $" + trackCwdEnv + "\nend\n" + command
+	}
+	return "trap 'pwd > \"$" + trackCwdEnv + "\"' EXIT\n" + command
+}
+
+// shellCommandLine returns the program and arguments that run command under shell
+func shellCommandLine(shell, command string) (string, []string) {
+	switch shell {
 	case "powershell", "pwsh":
 		// PowerShell (works on Windows, macOS, Linux if installed)
-		cmd = exec.CommandContext(execCtx, "powershell", "-NoProfile", "-NonInteractive", "-Command", command)
+		return "powershell", []string{"-NoProfile", "-NonInteractive", "-Command", command}
 	case "cmd":
 		// Windows cmd.exe
-		cmd = exec.CommandContext(execCtx, "cmd", "/C", command)
-	case "bash":
-		cmd = exec.CommandContext(execCtx, "bash", "-c", command)
-	case "zsh":
-		cmd = exec.CommandContext(execCtx, "zsh", "-c", command)
-	case "sh":
-		cmd = exec.CommandContext(execCtx, "sh", "-c", command)
+		return "cmd", []string{"/C", command}
 	default:
-		// Auto-detect based on OS
-		if runtime.GOOS == "windows" {
-			cmd = exec.CommandContext(execCtx, "cmd", "/C", command)
-		} else {
-			cmd = exec.CommandContext(execCtx, "sh", "-c", command)
+		return shell, []string{"-c", command}
+	}
+}
+
+// lookupOutputEncoding resolves a charset name such as "cp437" or
+// "windows-1252". An empty name means output is passed through as UTF-8.
+func lookupOutputEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if enc, err := ianaindex.IANA.Encoding(name); err == nil && enc != nil {
+		return enc, nil
+	}
+	if enc, err := htmlindex.Get(name); err == nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported output_encoding '%s'", name)
+}
+
+// syncWriter serializes writes to w from multiple goroutines
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// countingWriter passes writes through to w and counts the bytes written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// executeCommand runs the shell command with timeout
+func (t *ori_shell_executorTool) executeCommand(ctx context.Context, opts execOptions) (map[string]interface{}, error) {
+	command := opts.Command
+	workingDir := opts.WorkingDir
+	timeoutSeconds := opts.TimeoutSeconds
+	shell := opts.Shell
+	env := opts.Env
+
+	// Wait for an execution slot before the timeout starts counting; the
+	// caller's context can still cancel the wait
+	if err := execSlots.acquire(ctx, opts.MaxConcurrent); err != nil {
+		return nil, fmt.Errorf("cancelled while waiting for an execution slot: %w", err)
+	}
+	defer execSlots.release()
+
+	// Create context with timeout
+	execCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Create command based on shell selection, failing early if the shell is
+	// missing. A missing argv program or wrapper is reported as not_found; the
+	// shell may only exist wherever the wrapper runs it.
+	if len(opts.Argv) == 0 && len(opts.CommandPrefix) == 0 {
+		if err := checkShellAvailable(shell, opts.PathOverride); err != nil {
+			return nil, err
+		}
+	}
+	// To track the final directory, the shell writes it to a temp file on exit
+	script := command
+	var cwdFile string
+	if opts.TrackCwd {
+		f, err := os.CreateTemp("", "ori-shell-cwd-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create working directory tracking file: %w", err)
 		}
+		f.Close()
+		cwdFile = f.Name()
+		defer os.Remove(cwdFile)
+
+		script = trackCwdScript(shell, command)
+		env = maps.Clone(env)
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[trackCwdEnv] = cwdFile
+	}
+
+	commandLine := buildCommandLine(opts.CommandPrefix, opts.Argv, shell, script)
+	cmd := exec.CommandContext(execCtx, commandLine[0], commandLine[1:]...)
+	applyPathOverride(cmd, commandLine[0], opts.PathOverride)
+	stopKill := configureProcessGroup(cmd, time.Duration(opts.GraceSeconds)*time.Second)
+	cmd.WaitDelay = time.Duration(opts.GraceSeconds)*time.Second + outputDrainDelay
+	if err := setCredential(cmd, opts.RunAsUID, opts.RunAsGID); err != nil {
+		return nil, err
 	}
 	cmd.Dir = workingDir
 
-	// Capture output
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Apply the environment filters and per-command overrides; a nil Env
+	// inherits everything
+	cmd.Env = commandEnv(env, opts)
+
+	// Feed stdin data; exec copies it from a separate goroutine and closes the
+	// pipe at EOF, so a command producing lots of output cannot deadlock us
+	if opts.Stdin != "" {
+		cmd.Stdin = strings.NewReader(opts.Stdin)
+	}
+
+	// Capture output, truncating each stream at the configured limit. When
+	// combining, both streams share one writer so exec uses a single pipe and
+	// the bytes keep the order in which the command produced them.
+	var stdout, stderr, combined *cappedBuffer
+	var stdoutWriter, stderrWriter io.Writer
+	if opts.CombineOutput {
+		combined = newCappedBuffer(opts.MaxOutputBytes, opts.TruncateMode)
+		stdoutWriter = &syncWriter{w: combined}
+	} else {
+		stdoutLimit, stderrLimit := opts.streamLimits()
+		stdout = newCappedBuffer(stdoutLimit, opts.TruncateMode)
+		stderr = newCappedBuffer(stderrLimit, opts.TruncateMode)
+		stdoutWriter, stderrWriter = stdout, stderr
+	}
+
+	// Output sent to a file skips the buffers; the result only reports its size
+	var stdoutCount, stderrCount *countingWriter
+	if opts.StdoutFile != "" {
+		f, err := os.Create(opts.StdoutFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout_file: %w", err)
+		}
+		defer f.Close()
+		stdoutCount = &countingWriter{w: f}
+		stdoutWriter = stdoutCount
+	}
+	if opts.StderrFile != "" {
+		f, err := os.Create(opts.StderrFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stderr_file: %w", err)
+		}
+		defer f.Close()
+		stderrCount = &countingWriter{w: f}
+		stderrWriter = stderrCount
+	}
+
+	// In streaming mode, also deliver each line as it arrives
+	var streamWriters []*lineWriter
+	if opts.Stream {
+		handler := opts.StreamHandler
+		if handler == nil {
+			handler = t.handler()
+		}
+		handler = redactingHandler(handler, opts.Redactions)
+		if opts.CombineOutput {
+			lines := newLineWriter("combined", handler)
+			streamWriters = append(streamWriters, lines)
+			stdoutWriter = io.MultiWriter(stdoutWriter, lines)
+		} else {
+			stdoutLines := newLineWriter("stdout", handler)
+			stderrLines := newLineWriter("stderr", handler)
+			streamWriters = append(streamWriters, stdoutLines, stderrLines)
+			stdoutWriter = io.MultiWriter(stdoutWriter, stdoutLines)
+			stderrWriter = io.MultiWriter(stderrWriter, stderrLines)
+		}
+	}
+
+	// For debugging, also show the output live on the plugin's console
+	if opts.TeeToConsole {
+		stdoutWriter = io.MultiWriter(stdoutWriter, os.Stdout)
+		if !opts.CombineOutput {
+			stderrWriter = io.MultiWriter(stderrWriter, os.Stderr)
+		}
+	}
+
+	cmd.Stdout = stdoutWriter
+	if opts.CombineOutput {
+		cmd.Stderr = stdoutWriter
+	} else {
+		cmd.Stderr = stderrWriter
+	}
+
+	// Run command, timing it even if it fails or times out
+	startedAt := time.Now()
+	err := startCommand(cmd, opts.Umask)
+	var niced bool
+	if err == nil {
+		niced = setNice(cmd, opts.Nice)
+		err = cmd.Wait()
+		stopKill()
+	}
+	finishedAt := time.Now()
+	for _, w := range streamWriters {
+		w.Flush()
+	}
+
+	// Convert non-UTF-8 console output (e.g. Windows codepages) before encoding
+	captured := []*cappedBuffer{stdout, stderr}
+	if opts.CombineOutput {
+		captured = []*cappedBuffer{combined}
+	}
+	if opts.OutputEncoding != nil {
+		for _, buf := range captured {
+			if decodeErr := buf.Decode(opts.OutputEncoding); decodeErr != nil {
+				return nil, fmt.Errorf("failed to decode command output: %w", decodeErr)
+			}
+		}
+	}
 
-	// Run command
-	err := cmd.Run()
+	// Scrub secrets before the output reaches the result or any log
+	redacted := 0
+	for _, buf := range captured {
+		redacted += buf.Redact(opts.Redactions)
+	}
 
 	// Build result
 	result := map[string]interface{}{
-		"command":     command,
-		"working_dir": workingDir,
-		"stdout":      stdout.String(),
-		"stderr":      stderr.String(),
-		"exit_code":   0,
+		"command":      command,
+		"command_line": commandLine,
+		"working_dir":  workingDir,
+		"exit_code":    0,
+		"duration_ms":  finishedAt.Sub(startedAt).Milliseconds(),
+		"started_at":   startedAt.UTC().Format(time.RFC3339Nano),
+		"finished_at":  finishedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if len(opts.Argv) > 0 {
+		result["argv"] = opts.Argv
+	} else {
+		result["shell"] = shell
+	}
+	if opts.CombineOutput {
+		result["combined"] = combined.String()
+		result["truncated"] = combined.Truncated()
+	} else {
+		result["stdout"] = stdout.String()
+		result["stderr"] = stderr.String()
+		result["truncated"] = stdout.Truncated() || stderr.Truncated()
+		result["stdout_truncated"] = stdout.Truncated()
+		result["stderr_truncated"] = stderr.Truncated()
+	}
+	if stdoutCount != nil {
+		delete(result, "stdout")
+		result["stdout_file"] = opts.StdoutFile
+		result["stdout_bytes"] = stdoutCount.n
+	}
+	if stderrCount != nil {
+		delete(result, "stderr")
+		result["stderr_file"] = opts.StderrFile
+		result["stderr_bytes"] = stderrCount.n
+	}
+	if redacted > 0 {
+		result["redactions"] = redacted
+	}
+	if niced {
+		result["nice"] = opts.Nice
+	}
+
+	// The pid lets the run be matched up with OS process accounting
+	if cmd.Process != nil {
+		result["pid"] = cmd.Process.Pid
+	}
+
+	// Resource usage is only known once the process has been waited for, so a
+	// command that never started has none
+	if state := cmd.ProcessState; state != nil {
+		result["user_time_ms"] = state.UserTime().Milliseconds()
+		result["system_time_ms"] = state.SystemTime().Milliseconds()
+		if maxRSS, ok := maxRSSKB(state); ok {
+			result["max_rss_kb"] = maxRSS
+		}
+	}
+	if cwdFile != "" {
+		delete(env, trackCwdEnv)
+		if data, err := os.ReadFile(cwdFile); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			result["final_working_dir"] = string(bytes.TrimSpace(data))
+		}
+	}
+	if len(env) > 0 {
+		result["env"] = env
+	}
+	if opts.Stream {
+		result["streamed"] = true
+	}
+	if opts.RunAsUID != nil || opts.RunAsGID != nil {
+		uid, gid := os.Getuid(), os.Getgid()
+		if opts.RunAsUID != nil {
+			uid = *opts.RunAsUID
+		}
+		if opts.RunAsGID != nil {
+			gid = *opts.RunAsGID
+		}
+		result["uid"] = uid
+		result["gid"] = gid
 	}
 
+	// error_kind separates failures that share an exit code: -1 is used for a
+	// timeout, a cancellation and a command that could not be started
+	// (exitCodeExecError), and 127 follows the shell convention for "not found"
 	if err != nil {
 		if execCtx.Err() == context.DeadlineExceeded {
 			result["error"] = fmt.Sprintf("command timed out after %d seconds", timeoutSeconds)
 			result["exit_code"] = -1
+			result["timed_out"] = true
+			result["error_kind"] = errorKindTimeout
+		} else if execCtx.Err() == context.Canceled {
+			result["error"] = "command cancelled"
+			result["exit_code"] = exitCodeExecError
+			result["cancelled"] = true
+			result["error_kind"] = errorKindCancelled
 		} else if exitErr, ok := err.(*exec.ExitError); ok {
 			result["exit_code"] = exitErr.ExitCode()
 			result["error"] = err.Error()
+			if exitErr.ExitCode() == exitCodeNotFound {
+				result["error_kind"] = errorKindNotFound
+			}
+		} else if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			result["error"] = err.Error()
+			result["exit_code"] = exitCodeNotFound
+			result["error_kind"] = errorKindNotFound
 		} else {
 			result["error"] = err.Error()
-			result["exit_code"] = -1
+			result["exit_code"] = exitCodeExecError
+			result["error_kind"] = errorKindExecError
 		}
 	}
 
-	// Return as JSON
-	output, _ := json.MarshalIndent(result, "", "  ")
-	return string(output), nil
+	return result, nil
+}
+
+// patternMatcher holds the settings that control how commands are compared
+// with allowed and blocked patterns
+type patternMatcher struct {
+	syntax          string
+	caseInsensitive bool
+	aliases         map[string][]string // program -> other names it is invoked by
+	requireArgs     bool                // trailing spaces are kept, see matchesArgsPattern
+}
+
+// newPatternMatcher returns the matcher configured by settings
+func newPatternMatcher(settings Settings) patternMatcher {
+	return patternMatcher{
+		syntax:          settings.PatternSyntax,
+		caseInsensitive: settings.CaseInsensitiveMatching,
+		aliases:         settings.ProgramAliases,
+		requireArgs:     !settings.TrimPatterns,
+	}
+}
+
+// forms returns command followed by a rewrite of it for every program that
+// its program is an alias of, so "python3 x.py" is also checked as
+// "python x.py" when python3 is an alias of python
+func (m patternMatcher) forms(command string) []string {
+	forms := []string{command}
+	program, args, ok := splitProgram(command)
+	if !ok {
+		return forms
+	}
+	for _, canonical := range slices.Sorted(maps.Keys(m.aliases)) {
+		isAlias := slices.ContainsFunc(m.aliases[canonical], func(alias string) bool {
+			return alias == program || (m.caseInsensitive && strings.EqualFold(alias, program))
+		})
+		if !isAlias {
+			continue
+		}
+		if args != "" {
+			forms = append(forms, canonical+" "+args)
+		} else {
+			forms = append(forms, canonical)
+		}
+	}
+	return forms
+}
+
+// match checks command against pattern using the configured syntax.
+// Regex patterns are compiled on each call so edits to the settings file
+// take effect immediately; an invalid regex or path pattern is reported
+// instead of ignored.
+func (m patternMatcher) match(command, pattern string) (bool, error) {
+	// "prog:git" compares only the program name, whatever the syntax
+	if program, ok := strings.CutPrefix(pattern, programPatternPrefix); ok {
+		return m.matchProgram(command, program), nil
+	}
+
+	if m.syntax != patternSyntaxRegex {
+		if m.caseInsensitive {
+			command, pattern = strings.ToLower(command), strings.ToLower(pattern)
+		}
+		if m.syntax != patternSyntaxPath {
+			if m.requireArgs {
+				return matchesArgsPattern(command, pattern), nil
+			}
+			return matchesPattern(command, pattern), nil
+		}
+		// path.Match: * and ? stop at '/', [...] classes, \ escapes, and the
+		// whole command must match with no "ls *" also matching "ls"
+		matched, err := path.Match(pattern, command)
+		if err != nil {
+			return false, fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+		return matched, nil
+	}
+
+	expr := pattern
+	if m.caseInsensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return false, fmt.Errorf("invalid regex pattern '%s': %w", pattern, err)
+	}
+	return re.MatchString(command), nil
+}
+
+// matchProgram reports whether the first whitespace-delimited token of
+// command equals program
+func (m patternMatcher) matchProgram(command, program string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	if m.caseInsensitive {
+		return strings.EqualFold(fields[0], strings.TrimSpace(program))
+	}
+	return fields[0] == strings.TrimSpace(program)
 }
 
-// matchesPattern checks if command matches a glob-like pattern
+// matchesPattern checks if command matches a glob-like pattern.
+// Each * matches any run of characters, so patterns may contain several
+// wildcards ("docker * run *", "* --dry-run", "a*b*c"). A ? standing alone
+// as a word matches exactly one argument, so "kubectl get ? ?" only allows
+// two.
 func matchesPattern(command, pattern string) bool {
+	if matchesGlob(command, pattern) {
+		return true
+	}
+
+	// For patterns like "ls *", also match just "ls" (without args)
+	if base, ok := strings.CutSuffix(pattern, " *"); ok {
+		return matchesGlob(command, base)
+	}
+
+	return false
+}
+
+// matchesArgsPattern is matchesPattern for patterns kept as written with
+// trim_patterns off. A pattern ending in a space asks for at least one
+// argument, so "ls " matches "ls -la" but not a bare "ls".
+func matchesArgsPattern(command, pattern string) bool {
+	base, ok := strings.CutSuffix(pattern, " ")
+	if !ok {
+		return matchesPattern(command, pattern)
+	}
+	return matchesGlob(strings.TrimRight(command, " "), base+" *")
+}
+
+// matchesGlob reports whether command equals pattern or matches it as a glob
+func matchesGlob(command, pattern string) bool {
 	// Exact match
 	if command == pattern {
 		return true
 	}
 
-	// Simple glob matching with *
-	if strings.Contains(pattern, "*") {
-		// Convert to prefix/suffix matching
-		if strings.HasSuffix(pattern, "*") {
-			prefix := strings.TrimSuffix(pattern, "*")
-			if strings.HasPrefix(command, prefix) {
-				return true
-			}
-			// For patterns like "ls *", also match just "ls" (without args)
-			// prefix is "ls ", so check if command == "ls" (prefix without trailing space)
-			if strings.HasSuffix(prefix, " ") {
-				baseCmd := strings.TrimSuffix(prefix, " ")
-				if command == baseCmd {
-					return true
-				}
-			}
+	// Pattern like "git *" matches "git status", "git commit", etc.
+	if hasArgToken(pattern) {
+		return argGlobMatch(pattern, command)
+	}
+	return strings.Contains(pattern, "*") && globMatch(pattern, command)
+}
+
+// isArgToken reports whether pattern has a ? at p that is a word of its own
+func isArgToken(pattern string, p int) bool {
+	return pattern[p] == '?' &&
+		(p == 0 || pattern[p-1] == ' ') &&
+		(p+1 == len(pattern) || pattern[p+1] == ' ')
+}
+
+// hasArgToken reports whether pattern contains a ? word
+func hasArgToken(pattern string) bool {
+	for p := range len(pattern) {
+		if isArgToken(pattern, p) {
+			return true
 		}
-		if strings.HasPrefix(pattern, "*") {
-			suffix := strings.TrimPrefix(pattern, "*")
-			if strings.HasSuffix(command, suffix) {
-				return true
+	}
+	return false
+}
+
+// argGlobMatch is globMatch for patterns with ? words, each of which matches
+// one run of non-space characters in s. The * backtracking can't simply
+// resume past a ?, so this tries each split, remembering the (pattern, s)
+// positions that already failed.
+func argGlobMatch(pattern, s string) bool {
+	failed := make(map[[2]int]bool)
+	var match func(p, i int) bool
+	match = func(p, i int) bool {
+		if p == len(pattern) {
+			return i == len(s)
+		}
+		if failed[[2]int{p, i}] {
+			return false
+		}
+		var ok bool
+		switch {
+		case isArgToken(pattern, p):
+			end := i
+			for end < len(s) && s[end] != ' ' {
+				end++
 			}
+			ok = end > i && match(p+1, end)
+		case pattern[p] == '*':
+			ok = match(p+1, i) || (i < len(s) && match(p, i+1))
+		case i < len(s) && pattern[p] == s[i]:
+			ok = match(p+1, i+1)
 		}
-		// Pattern like "git *" matches "git status", "git commit", etc.
-		parts := strings.SplitN(pattern, "*", 2)
-		if len(parts) == 2 {
-			if strings.HasPrefix(command, parts[0]) && strings.HasSuffix(command, parts[1]) {
-				return true
+		if !ok {
+			failed[[2]int{p, i}] = true
+		}
+		return ok
+	}
+	return match(0, 0)
+}
+
+// globMatch reports whether s matches pattern, where * matches any (possibly
+// empty) sequence of characters and every other character is literal. On a
+// mismatch it backtracks to the most recent * and lets it absorb one more
+// character, which keeps matching linear in practice.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starI = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case starP >= 0:
+			starI++
+			p, i = starP+1, starI
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// shellOperators are the shell metacharacters checked to prevent command chaining.
+// Multi-character operators come first so "&&" is not read as two "&".
+var shellOperators = []string{
+	"&&",
+	"||",
+	"$(",
+	"|",
+	";",
+	"&",
+	">",
+	"<",
+	"`",
+	"\n",
+}
+
+// findShellMetacharacters returns the operators in command in order of
+// appearance, matching the first of operators that fits at each position.
+// Quoted text is skipped as described in scanShellOperators.
+func findShellMetacharacters(command, shell string, operators []string) []string {
+	var found []string
+	scanShellOperators(command, shell, operators, func(_ int, op string) {
+		found = append(found, op)
+	})
+	return found
+}
+
+// scanShellOperators calls fn with the index of each shell operator in command
+// that the shell would act on. Characters inside matched single quotes are
+// data; inside double quotes only $( and backticks still substitute. POSIX
+// shells also honour backslash escapes, and cmd has no single quotes. fish
+// substitutes an unquoted (cmd), so there "(" is reported as well whenever
+// operators include $(.
+func scanShellOperators(command, shell string, operators []string, fn func(i int, op string)) {
+	posix := shell != "cmd" && shell != "powershell" && shell != "pwsh"
+
+	var quote byte
+	for i := 0; i < len(command); {
+		c := command[i]
+		switch {
+		case quote == '\'':
+			if c == '\\' && shell == "fish" && i+1 < len(command) {
+				// fish allows \' and \\ inside single quotes
+				i += 2
+				continue
+			}
+			if c == '\'' {
+				quote = 0
+			}
+			i++
+		case quote == '"':
+			if c == '\\' && posix && i+1 < len(command) {
+				i += 2
+				continue
+			}
+			if c == '"' {
+				quote = 0
+				i++
+				continue
 			}
+			if op := operatorAt(command, i, operators); op == "$(" || op == "`" || op == ")" {
+				fn(i, op)
+				i += len(op)
+				continue
+			}
+			i++
+		case c == '\\' && posix && i+1 < len(command):
+			i += 2
+		case (c == '"' || c == '\'' && shell != "cmd") && strings.IndexByte(command[i+1:], c) >= 0:
+			// Only a quote with a closing partner starts a quoted run, so an
+			// unbalanced quote can't hide the rest of the line
+			quote = c
+			i++
+		default:
+			op := operatorAt(command, i, operators)
+			if op == "" && c == '(' && shell == "fish" && slices.Contains(operators, "$(") {
+				// fish substitutes (cmd) as other shells do $(cmd)
+				op = "("
+			}
+			if op == "" {
+				i++
+				continue
+			}
+			fn(i, op)
+			i += len(op)
 		}
 	}
+}
 
-	return false
+// operatorAt returns the first of operators that starts at index i, or ""
+func operatorAt(command string, i int, operators []string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(command[i:], op) {
+			return op
+		}
+	}
+	return ""
 }
 
-// containsShellMetacharacters checks for common shell operators to prevent command chaining.
-func containsShellMetacharacters(command string) bool {
-	if strings.Contains(command, "\n") {
-		return true
+// splitShellCommand splits command on shell operators into the sub-commands
+// it chains together. Pieces are trimmed of whitespace and subshell
+// parentheses, and empty pieces are dropped. Operators inside quotes do not
+// split.
+func splitShellCommand(command, shell string) []string {
+	var segments []string
+	appendSegment := func(segment string) {
+		segment = strings.Trim(segment, " \t\r()")
+		if segment != "" {
+			segments = append(segments, segment)
+		}
 	}
 
-	operators := []string{
-		"&&",
-		"||",
-		"|",
-		";",
-		"&",
-		">",
-		"<",
-		"`",
-		"$(",
+	start := 0
+	scanShellOperators(command, shell, shellOperators, func(i int, op string) {
+		appendSegment(command[start:i])
+		start = i + len(op)
+	})
+	appendSegment(command[start:])
+	return segments
+}
+
+// commandLines returns the non-empty lines of command, trimmed of whitespace.
+// Unlike splitShellCommand it ignores quoting.
+func commandLines(command string) []string {
+	var lines []string
+	for line := range strings.Lines(command) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
 	}
-	for _, op := range operators {
-		if strings.Contains(command, op) {
-			return true
+	return lines
+}
+
+// commandSegments splits command into the simple commands the shell would
+// run: the pieces joined by control operators, and the contents of $( ),
+// fish ( ) and backtick substitutions apart from the command they appear in. Redirections
+// are dropped together with their targets, since a target names a file, not
+// a command; commandRedirections returns those. Quoting is handled as in
+// scanShellOperators.
+func commandSegments(command, shell string) []string {
+	var segments []string
+	current := &strings.Builder{}
+	var enclosing []*strings.Builder // commands around open substitutions
+	var opened []string              // the operator that opened each one
+	start := 0
+	skipTarget := false
+
+	flush := func() {
+		if segment := strings.Trim(current.String(), " \t\r()"); segment != "" {
+			segments = append(segments, segment)
 		}
+		current.Reset()
 	}
-	return false
+	// take adds the text up to end to the current command, minus a pending
+	// redirection target
+	take := func(end int) {
+		piece := command[start:end]
+		if skipTarget && strings.TrimSpace(piece) != "" {
+			piece = strings.TrimLeft(piece, " \t")
+			if cut := strings.IndexAny(piece, " \t"); cut >= 0 {
+				piece = piece[cut:]
+			} else {
+				piece = ""
+			}
+			skipTarget = false
+		}
+		current.WriteString(piece)
+	}
+	open := func(op string) {
+		enclosing = append(enclosing, current)
+		opened = append(opened, op)
+		current = &strings.Builder{}
+	}
+	closeSubstitution := func() {
+		flush()
+		current = enclosing[len(enclosing)-1]
+		enclosing = enclosing[:len(enclosing)-1]
+		opened = opened[:len(opened)-1]
+	}
+	innermost := func() string {
+		if len(opened) == 0 {
+			return ""
+		}
+		return opened[len(opened)-1]
+	}
+
+	operators := append(slices.Clone(shellOperators), ")")
+	scanShellOperators(command, shell, operators, func(i int, op string) {
+		switch {
+		case op == ">" || op == "<":
+			take(i)
+			// An fd number written against the operator ("2>") is part of it
+			text := current.String()
+			trimmed := strings.TrimRight(text, "0123456789")
+			if trimmed != text && (trimmed == "" || strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t")) {
+				current.Reset()
+				current.WriteString(trimmed)
+			}
+			skipTarget = true
+		case op == "&" && (skipTarget && strings.TrimSpace(command[start:i]) == "" || strings.HasPrefix(command[i+1:], ">")):
+			// ">&2" duplicates a descriptor and "&>" redirects both streams
+			take(i)
+		case op == "$(", op == "(":
+			take(i)
+			open("$(")
+		case op == "`" && innermost() == "`", op == ")" && innermost() == "$(":
+			take(i)
+			closeSubstitution()
+		case op == "`":
+			take(i)
+			open(op)
+		case op == ")":
+			// Closes a subshell; the parenthesis is trimmed from the segment
+			return
+		default:
+			take(i)
+			flush()
+		}
+		start = i + len(op)
+	})
+	take(len(command))
+	flush()
+	for len(enclosing) > 0 {
+		closeSubstitution()
+		flush()
+	}
+	return segments
+}
+
+// redirection is a file redirection in a shell command: its operator,
+// normalized to >, >> or <, and the file it names
+type redirection struct {
+	op     string
+	target shellWord
+}
+
+// String returns the redirection as allowed and blocked patterns see it,
+// e.g. "> /tmp/out.txt"
+func (r redirection) String() string {
+	return r.op + " " + r.target.text
+}
+
+// commandRedirections returns the file redirections in command, which
+// commandSegments leaves out. A descriptor number ("2>") and the & of "&>"
+// are dropped, as is the | of ">|". Duplications like 2>&1 and here-documents
+// name no file and are skipped. Quoting is handled as in scanShellOperators.
+func commandRedirections(command, shell string) []redirection {
+	var redirections []redirection
+	scanShellOperators(command, shell, []string{"<<<", "<<", ">>", ">", "<"}, func(i int, op string) {
+		if strings.HasPrefix(op, "<<") {
+			return // a here-document or here-string
+		}
+		rest := strings.TrimPrefix(command[i+len(op):], "|")
+		duplicate := strings.HasPrefix(rest, "&")
+		rest = strings.TrimPrefix(rest, "&")
+		// The target ends at the next operator, as in ">out;rm x"
+		end := len(rest)
+		scanShellOperators(rest, shell, shellOperators, func(j int, _ string) {
+			end = min(end, j)
+		})
+		words := splitShellWords(rest[:end], shell)
+		if len(words) == 0 {
+			return
+		}
+		if duplicate && strings.Trim(words[0].text, "0123456789-") == "" {
+			return // a file descriptor, as in 2>&1 or <&-
+		}
+		redirections = append(redirections, redirection{op: op, target: words[0]})
+	})
+	return redirections
+}
+
+// sortOperators returns operators longest first, so a configured "&&" is
+// matched before "&" just like in shellOperators
+func sortOperators(operators []string) []string {
+	sorted := slices.Clone(operators)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return sorted
+}
+
+// parseMetacharacters parses a list of operators, accepting a literal \n for newline
+func parseMetacharacters(value interface{}) []string {
+	parsed := parseStringList(value)
+	for i, op := range parsed {
+		if op == `\n` {
+			parsed[i] = "\n"
+		}
+	}
+	return parsed
 }
 
 // DefaultSettings returns the default configuration
 func (t *ori_shell_executorTool) DefaultSettings() map[string]interface{} {
 	return map[string]interface{}{
-		"timeout_seconds":            60,
-		"default_working_dir":        defaultSettings.DefaultWorkingDir,
-		"allowed_patterns":           defaultSettings.AllowedPatterns,
-		"blocked_patterns":           defaultSettings.BlockedPatterns,
-		"allow_shell_metacharacters": defaultSettings.AllowShellMetacharacters,
+		"timeout_seconds":              60,
+		"max_timeout_seconds":          defaultSettings.MaxTimeoutSeconds,
+		"grace_seconds":                defaultSettings.GraceSeconds,
+		"nice":                         defaultSettings.Nice,
+		"max_command_length":           defaultSettings.MaxCommandLength,
+		"default_working_dir":          defaultSettings.DefaultWorkingDir,
+		"default_shell":                defaultSettings.DefaultShell,
+		"allowed_shells":               defaultSettings.AllowedShells,
+		"allowed_patterns":             defaultSettings.AllowedPatterns,
+		"allowed_subcommands":          defaultSettings.AllowedSubcommands,
+		"program_aliases":              defaultSettings.ProgramAliases,
+		"blocked_patterns":             defaultSettings.BlockedPatterns,
+		"confirm_patterns":             defaultSettings.ConfirmPatterns,
+		"advisory_patterns":            defaultSettings.AdvisoryPatterns,
+		"enforce_allowlist":            defaultSettings.EnforceAllowlist,
+		"allow_shell_metacharacters":   defaultSettings.AllowShellMetacharacters,
+		"pattern_syntax":               defaultSettings.PatternSyntax,
+		"case_insensitive_matching":    defaultSettings.CaseInsensitiveMatching,
+		"max_output_bytes":             defaultSettings.MaxOutputBytes,
+		"max_stdout_bytes":             defaultSettings.MaxStdoutBytes,
+		"max_stderr_bytes":             defaultSettings.MaxStderrBytes,
+		"truncate_mode":                defaultSettings.TruncateMode,
+		"allowed_metacharacters":       defaultSettings.AllowedMetacharacters,
+		"blocked_metacharacters":       defaultSettings.BlockedMetacharacters,
+		"allowed_working_dirs":         defaultSettings.AllowedWorkingDirs,
+		"allowed_path_roots":           defaultSettings.AllowedPathRoots,
+		"output_encoding":              defaultSettings.OutputEncoding,
+		"audit_log_path":               defaultSettings.AuditLogPath,
+		"tee_to_console":               defaultSettings.TeeToConsole,
+		"command_templates":            defaultSettings.CommandTemplates,
+		"aliases":                      defaultSettings.Aliases,
+		"max_concurrent":               defaultSettings.MaxConcurrent,
+		"trim_patterns":                defaultSettings.TrimPatterns,
+		"disabled":                     defaultSettings.Disabled,
+		"allowed_patterns_file":        defaultSettings.AllowedPatternsFile,
+		"blocked_patterns_file":        defaultSettings.BlockedPatternsFile,
+		"command_prefix":               defaultSettings.CommandPrefix,
+		"session_idle_timeout_seconds": defaultSettings.SessionIdleTimeout,
+		"redaction_patterns":           defaultSettings.RedactionPatterns,
+		"env_allowlist":                defaultSettings.EnvAllowlist,
+		"env_blocklist":                defaultSettings.EnvBlocklist,
+		"path_override":                defaultSettings.PathOverride,
 	}
 }
 
@@ -485,15 +4034,187 @@ func (t *ori_shell_executorTool) GetRequiredConfig() []pluginapi.ConfigVariable
 	return t.BasePlugin.GetConfigFromYAML()
 }
 
-// ValidateConfig checks if the provided configuration is valid
+// ValidateConfig checks if the provided configuration is valid. Every key is
+// optional, but a value that is present must parse; all problems are
+// reported together so they can be fixed in one pass instead of silently
+// falling back to defaults at runtime.
 func (t *ori_shell_executorTool) ValidateConfig(config map[string]interface{}) error {
-	// Basic validation - configuration is optional
-	return nil
+	var errs []error
+	present := func(key string) (interface{}, bool) {
+		value, ok := config[key]
+		if !ok || value == nil || value == "" {
+			return nil, false
+		}
+		return value, true
+	}
+
+	for _, check := range []struct {
+		key     string
+		minimum int
+	}{
+		{"timeout_seconds", 1},
+		{"max_timeout_seconds", 1},
+		{"grace_seconds", 0},
+		{"max_command_length", 0},
+		{"max_output_bytes", 0},
+		{"max_stdout_bytes", 0},
+		{"max_stderr_bytes", 0},
+		{"max_concurrent", 0},
+		{"session_idle_timeout_seconds", 1},
+	} {
+		if value, ok := present(check.key); ok {
+			if parsed, ok := parseInt(value); !ok || parsed < check.minimum {
+				errs = append(errs, fmt.Errorf("%s must be an integer >= %d, got %v", check.key, check.minimum, value))
+			}
+		}
+	}
+	if value, ok := present("nice"); ok {
+		if parsed, ok := parseInt(value); !ok || parsed < 0 || parsed > maxNice {
+			errs = append(errs, fmt.Errorf("nice must be an integer from 0 to %d, got %v", maxNice, value))
+		}
+	}
+
+	for _, key := range []string{"enforce_allowlist", "allow_shell_metacharacters", "case_insensitive_matching", "trim_patterns", "tee_to_console", "disabled"} {
+		if value, ok := present(key); ok {
+			if _, ok := parseBool(value); !ok {
+				errs = append(errs, fmt.Errorf("%s must be a boolean, got %v", key, value))
+			}
+		}
+	}
+
+	syntax := patternSyntaxGlob
+	if value, ok := present("pattern_syntax"); ok {
+		parsed, _ := value.(string)
+		switch parsed = strings.ToLower(strings.TrimSpace(parsed)); parsed {
+		case patternSyntaxGlob, patternSyntaxRegex, patternSyntaxPath:
+			syntax = parsed
+		default:
+			errs = append(errs, fmt.Errorf("pattern_syntax must be '%s', '%s' or '%s', got %v", patternSyntaxGlob, patternSyntaxRegex, patternSyntaxPath, value))
+		}
+	}
+	if value, ok := present("default_shell"); ok {
+		parsed, _ := value.(string)
+		if _, err := resolveShell(strings.ToLower(strings.TrimSpace(parsed))); err != nil {
+			errs = append(errs, fmt.Errorf("default_shell: %w", err))
+		}
+	}
+	if value, ok := present("allowed_shells"); ok {
+		shells := parseAllowedShells(value)
+		for _, shell := range shells {
+			if _, err := resolveShell(shell); err != nil && !filepath.IsAbs(shell) {
+				errs = append(errs, fmt.Errorf("allowed_shells: %w", err))
+			}
+		}
+		defaultShell, _ := config["default_shell"].(string)
+		if defaultShell = strings.ToLower(strings.TrimSpace(defaultShell)); defaultShell != "" && len(shells) > 0 && !slices.Contains(shells, defaultShell) {
+			errs = append(errs, fmt.Errorf("default_shell '%s' is not in allowed_shells", defaultShell))
+		}
+	}
+	if value, ok := present("umask"); ok {
+		parsed, _ := value.(string)
+		if _, err := parseUmask(strings.TrimSpace(parsed)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if value, ok := present("truncate_mode"); ok {
+		parsed, _ := value.(string)
+		switch strings.ToLower(strings.TrimSpace(parsed)) {
+		case truncateModeHead, truncateModeTail, truncateModeBoth:
+		default:
+			errs = append(errs, fmt.Errorf("truncate_mode must be head, tail or both, got %v", value))
+		}
+	}
+
+	for _, key := range []string{"allowed_patterns", "blocked_patterns", "allowed_patterns_unix", "blocked_patterns_unix", "allowed_patterns_windows", "blocked_patterns_windows", "confirm_patterns", "advisory_patterns", "redaction_patterns"} {
+		value, ok := present(key)
+		if !ok {
+			continue
+		}
+		var patterns []string
+		if key == "redaction_patterns" {
+			patterns, ok = stringListValue(value)
+		} else {
+			patterns, ok = patternListValue(value)
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s must be a list of strings", key))
+			continue
+		}
+		if syntax == patternSyntaxGlob && key != "redaction_patterns" {
+			continue
+		}
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, programPatternPrefix) {
+				continue
+			}
+			if syntax == patternSyntaxPath && key != "redaction_patterns" {
+				if _, err := path.Match(pattern, ""); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid path pattern '%s': %w", key, pattern, err))
+				}
+				continue
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid regex '%s': %w", key, pattern, err))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+}
+
+// stringListValue converts a newline-separated string or an array whose
+// items are all strings into a list, reporting false for anything else
+func stringListValue(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case string, []string:
+		return parseStringList(v), true
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.(string); !ok {
+				return nil, false
+			}
+		}
+		return parseStringList(v), true
+	}
+	return nil, false
+}
+
+// patternListValue is stringListValue for allowed and blocked pattern lists,
+// whose array entries may also be {"pattern": ..., "reason": ...} objects
+func patternListValue(value interface{}) ([]string, bool) {
+	items, isArray := value.([]interface{})
+	if !isArray {
+		return stringListValue(value)
+	}
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+		case map[string]interface{}:
+			if _, ok := v["pattern"].(string); !ok {
+				return nil, false
+			}
+			if reason, ok := v["reason"]; ok {
+				if _, ok := reason.(string); !ok {
+					return nil, false
+				}
+			}
+		default:
+			return nil, false
+		}
+	}
+	return parsePatternList(value, true), true
 }
 
 // InitializeWithConfig sets up the plugin with the provided configuration
 func (t *ori_shell_executorTool) InitializeWithConfig(config map[string]interface{}) error {
-	// Configuration is handled via Settings API, no additional initialization needed
+	// Configuration is handled via Settings API; only the bypass token is kept
+	// here so it never shows up in settings output
+	if token, ok := config["bypass_token"].(string); ok {
+		t.bypassToken = strings.TrimSpace(token)
+	}
 	return nil
 }
 
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestMatchesPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		command string
+		want    bool
+	}{
+		{"git * --force", "git push --force", true},
+		{"git * --force", "git push origin main --force", true},
+		{"git * --force", "git push --force-with-lease", false},
+		{"git * --force", "git --force", false},
+		{"git * --force", "hg push --force", false},
+
+		{"* --dry-run", "terraform apply --dry-run", true},
+		{"* --dry-run", "kubectl apply -f x.yaml --dry-run", true},
+		{"* --dry-run", "terraform apply", false},
+		{"* --dry-run", "terraform apply --dry-run --force", false},
+
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "abcbc", true},
+		{"a*b*c", "acb", false},
+		{"a*b*c", "abcd", false},
+
+		{"docker * run *", "docker container run nginx", true},
+		{"docker * run *", "docker -H host run -it alpine sh", true},
+		{"docker * run *", "docker run nginx", false},
+		{"docker * run *", "docker container exec nginx", false},
+		{"docker * run *", "podman container run nginx", false},
+	}
+	for _, tt := range tests {
+		if got := matchesPattern(tt.command, tt.pattern); got != tt.want {
+			t.Errorf("matchesPattern(%q, %q) = %v, want %v", tt.command, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything at all", true},
+		{"git *", "git status", true},
+		{"git *", "git", false},
+		{"*.log", "app.log", true},
+		{"*.log", "app.log.1", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"x**y", "xzzy", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPatternMatcherPathSyntax(t *testing.T) {
+	matcher := patternMatcher{syntax: patternSyntaxPath}
+	tests := []struct {
+		pattern string
+		command string
+		want    bool
+	}{
+		{"cat *", "cat notes.txt", true},
+		{"cat *", "cat src/main.go", false},
+		{"cat */*", "cat src/main.go", true},
+
+		{"ls ?", "ls a", true},
+		{"ls ?", "ls ab", false},
+		{"ls ?", "ls /", false},
+
+		{"git [abc]*", "git add .", true},
+		{"git [abc]*", "git commit", true},
+		{"git [abc]*", "git push", false},
+		{"make [a-z]*", "make build", true},
+		{"make [a-z]*", "make Build", false},
+
+		{`echo \*`, "echo *", true},
+		{`echo \*`, "echo hello", false},
+		{`echo \?`, "echo ?", true},
+
+		{"ls *", "ls", false},
+		{"ls *", "ls -la", true},
+	}
+	for _, tt := range tests {
+		got, err := matcher.match(tt.command, tt.pattern)
+		if err != nil {
+			t.Errorf("match(%q, %q) returned error: %v", tt.command, tt.pattern, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.command, tt.pattern, got, tt.want)
+		}
+	}
+
+	if _, err := matcher.match("ls x", "ls x["); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("match with malformed pattern returned %v, want path.ErrBadPattern", err)
+	}
+}
+
+func TestMatchesArgsPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		command string
+		want    bool
+	}{
+		{"ls ", "ls foo", true},
+		{"ls ", "ls -la /tmp", true},
+		{"ls ", "ls", false},
+		{"ls *", "ls foo", true},
+		{"ls *", "ls", true},
+		{"git *", "git", true},
+		{"git * ", "git push origin", true},
+		{"git * ", "git push", false},
+		{"ls", "ls", true},
+		{"ls", "ls foo", false},
+	}
+	for _, tt := range tests {
+		if got := matchesArgsPattern(tt.command, tt.pattern); got != tt.want {
+			t.Errorf("matchesArgsPattern(%q, %q) = %v, want %v", tt.command, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCommandFishSubstitution(t *testing.T) {
+	tool := &ori_shell_executorTool{}
+	settings := defaultSettings
+	settings.AllowedPatterns = []string{"echo *"}
+	settings.BlockedPatterns = []string{"sudo *", "rm -rf *"}
+
+	for _, command := range []string{"echo (sudo reboot)", "echo (rm -rf ~)"} {
+		if _, err := tool.validateCommand(command, "fish", settings); !errors.Is(err, ErrShellMetacharacters) {
+			t.Errorf("validateCommand(%q) with metacharacters disallowed returned %v, want ErrShellMetacharacters", command, err)
+		}
+	}
+
+	settings.AllowShellMetacharacters = true
+	settings.EnforceAllowlist = true
+	if _, err := tool.validateCommand("echo (sudo reboot)", "fish", settings); !errors.Is(err, ErrBlockedPattern) {
+		t.Errorf("validateCommand with substituted sudo returned %v, want ErrBlockedPattern", err)
+	}
+	if _, err := tool.validateCommand("echo (whoami)", "fish", settings); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("validateCommand with substituted whoami returned %v, want ErrNotAllowed", err)
+	}
+	if _, err := tool.validateCommand("echo '(whoami)'", "fish", settings); err != nil {
+		t.Errorf("validateCommand with quoted parentheses returned %v, want nil", err)
+	}
+}
+
+func TestRenderCommandTemplateFishQuoting(t *testing.T) {
+	templates := map[string]string{"echo2": "echo {{.a}} {{.b}}"}
+	args := map[string]string{"a": `x\`, "b": "'; sudo reboot #"}
+
+	got, err := renderCommandTemplate(templates, "echo2", args, "fish")
+	if err != nil {
+		t.Fatalf("renderCommandTemplate returned error: %v", err)
+	}
+	want := `echo 'x\\' '\'; sudo reboot #'`
+	if got != want {
+		t.Errorf("renderCommandTemplate = %q, want %q", got, want)
+	}
+	if _, err := (&ori_shell_executorTool{}).validateCommand(got, "fish", defaultSettings); err != nil {
+		t.Errorf("rendered command %q was rejected: %v", got, err)
+	}
+}
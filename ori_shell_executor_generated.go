@@ -23,10 +23,52 @@ var (
 
 // OriShellExecutorParams represents the parameters for this plugin
 type OriShellExecutorParams struct {
-	Command        string `json:"command"`         // The shell command to execute. Must match allowed patterns and not match blocked patterns.
-	WorkingDir     string `json:"working_dir"`     // Working directory for command execution. Defaults to configured default_working_dir or agent context.
-	TimeoutSeconds int    `json:"timeout_seconds"` // Command timeout in seconds (1-300). Defaults to 60.
-	Shell          string `json:"shell"`           // Shell to use: sh, bash, zsh, powershell, cmd. Defaults to sh on Unix, cmd on Windows.
+	Action                   string            `json:"action"`                     // What to do: execute (default) runs the command; get_settings returns the effective settings and which settings file they were loaded from; cancel stops the running or detached command identified by run_id; close_session ends the session identified by session_id. selftest runs a harmless echo through validation and execution and reports which stages worked, the OS and the shells found on PATH. get_stats returns how many commands were rejected since startup, by category, and when the last rejection happened. get_effective_patterns returns the allowed and blocked patterns in force, with allowed_patterns and blocked_patterns params applied, each labelled with its source: default, settings, file or param. status reports the detached command identified by run_id: whether it is running, its exit code once finished and its newest output. test_pattern checks each of commands against pattern with the configured pattern_syntax, case_insensitive_matching and program_aliases, without running anything, and lists which match.
+	RunID                    string            `json:"run_id"`                     // Identifier for this run, used by the cancel action to stop it and by the status action for detached commands. For execute it is optional: a random id is generated if omitted, returned as run_id in the result and, in streaming mode, announced before any output. Required for cancel and status.
+	CorrelationID            string            `json:"correlation_id"`             // Caller-supplied identifier, e.g. of the higher-level task that issued the command, echoed as correlation_id in the result and in the audit log line so commands can be traced across agents sharing one log.
+	SessionID                string            `json:"session_id"`                 // Run the command in a persistent shell session with this id, so cd, exported variables and shell variables carry over between calls. The session starts on first use with that call's shell (sh, bash or zsh), working_dir and env, and is closed after session_idle_timeout_seconds without a command, on timeout, or by the close_session action. Commands still go through allowed/blocked validation and read stdin from /dev/null. Cannot be combined with argv, stdin, stream, track_cwd or retries.
+	Command                  string            `json:"command"`                    // The shell command to execute. Must match allowed patterns and not match blocked patterns. Required for the execute action unless command_file, template, argv or commands is set. ${AGENT_DIR}, ${WORKING_DIR} and ${TIMESTAMP} are replaced before validation with the agent directory, the resolved working directory and the current UTC time (e.g. 20260102T150405Z), shell-quoted, so write them unquoted; in argv they are replaced as is.
+	CommandFile              string            `json:"command_file"`               // Path to a script file whose contents are run as the command, resolved against the working directory when relative. The script passes through the same metacharacter and pattern validation as command (so multi-line scripts need newlines allowed) and the result records its path as command_file. The file must be inside allowed_working_dirs and at most 1 MiB. Mutually exclusive with command, template and argv.
+	Argv                     []string          `json:"argv"`                       // Program and literal arguments to run directly without a shell, e.g. ["git", "log", "--oneline"]. Arguments are never interpreted by a shell, so metacharacter checks are skipped; allowed and blocked patterns are matched against the space-joined form. Mutually exclusive with command, template, shell and shell_path.
+	ExpandGlobs              bool              `json:"expand_globs"`               // Expand filesystem globs (*, ?, [...]) in argv arguments relative to the working directory before running, since there is no shell to do it. Matches are spliced in sorted; arguments without glob characters and argv[0] pass through unchanged. The expanded form is validated against allowed and blocked patterns again. Requires argv. Defaults to false.
+	GlobNoMatch              string            `json:"glob_no_match"`              // What expand_globs does with a glob that matches nothing: literal (default) passes it through unchanged, error rejects the call.
+	Commands                 []string          `json:"commands"`                   // Several independent commands to run one after another in a single call. Each goes through the full validation and execution pipeline and the result is a JSON array with one object per command; a rejected command appears with its error instead of aborting the batch. Mutually exclusive with command, command_file, template and argv. For test_pattern, the candidate commands to check against pattern.
+	Pattern                  string            `json:"pattern"`                    // Allowed or blocked pattern to preview with the test_pattern action, written as it would be in the settings. ${NAME} environment references are expanded as they are when settings load.
+	WorkingDir               string            `json:"working_dir"`                // Working directory for command execution. Defaults to configured default_working_dir or agent context.
+	CreateWorkingDir         bool              `json:"create_working_dir"`         // Create the working directory (and any missing parents) if it does not exist. It must still be inside allowed_working_dirs. Defaults to false, where a missing directory is an error.
+	TrackCwd                 bool              `json:"track_cwd"`                  // Report the directory the shell ended up in (e.g. after cd) as final_working_dir, so a caller can carry it into the next call. Works with sh, bash, zsh and fish; not with powershell, cmd or argv.
+	TimeoutSeconds           int               `json:"timeout_seconds"`            // Command timeout in seconds. Defaults to 60; values above the configured max_timeout_seconds (300 by default) are clamped and reported as timeout_clamped. A command that times out still returns the stdout and stderr it produced before it was killed. Its exit_code is -1, which a cancelled run and one that failed to start (exec_error) also report, so use error_kind (timeout, cancelled, exec_error, not_found) rather than exit_code to tell these cases apart.
+	Shell                    string            `json:"shell"`                      // Shell to use: sh, bash, zsh, fish, powershell, cmd. Defaults to the configured default_shell, else sh on Unix and cmd on Windows. Must be listed in allowed_shells when that is configured.
+	ShellPath                string            `json:"shell_path"`                 // Absolute path to a shell binary to use instead of shell, e.g. /usr/local/bin/bash. The binary is invoked with -c and must exist and be executable.
+	Env                      map[string]string `json:"env"`                        // Environment variables to set for this command only, merged over the inherited environment. Values here override inherited variables with the same name.
+	Stream                   bool              `json:"stream"`                     // Stream stdout/stderr line by line while the command runs, in addition to returning the full result. Useful for long-running commands like builds and test suites.
+	StreamFormat             string            `json:"stream_format"`              // Format of streamed output: lines (default) delivers each output line tagged with its stream; ndjson delivers one JSON event per line instead, with a stable schema: a start event (run_id, command, shell or argv, working_dir), an output event per line (stream, line) and a final result event (exit_code, status, duration_ms, error). Every event has type, run_id and time. The full result is still returned. Requires stream.
+	Stdin                    string            `json:"stdin"`                      // Data to write to the command's standard input. The input is closed after writing so commands that read until EOF (sort, jq, grep) terminate.
+	AllowedPatterns          []string          `json:"allowed_patterns"`           // Allowed command patterns for this call only. When non-empty, replaces the configured allowed_patterns list.
+	AllowShellMetacharacters *bool             `json:"allow_shell_metacharacters"` // Override the configured allow_shell_metacharacters for this call only; omit or pass null to use the setting. true permits every shell operator, as the setting does, while each chained command must still pass the allowed and blocked patterns. false rejects operators even if the setting allows them, except those listed in allowed_metacharacters; blocked_metacharacters still defines which operators count.
+	BlockedPatterns          []string          `json:"blocked_patterns"`           // Blocked command patterns for this call only. When non-empty, replaces the configured blocked_patterns list. Blocked patterns are still checked before allowed patterns.
+	Confirmed                bool              `json:"confirmed"`                  // Confirm a command that matches confirm_patterns so it runs. Only set this after the command was approved; without it such commands return status needs_confirmation and are not executed.
+	Detach                   bool              `json:"detach"`                     // Start the command in the background and return at once with its run_id and pid instead of waiting, e.g. for a dev server or file watcher. The timeout does not apply; use the status action with the run_id to see whether it is still running, its exit code and its newest output, and the cancel action to stop it. Finished commands stay queryable for 10 minutes. Cannot be combined with session_id, stream, track_cwd, retries or output_format text.
+	DryRun                   bool              `json:"dry_run"`                    // Validate the command and resolve the shell, working directory and timeout without executing it. Returns would_execute and, if rejected, the reason.
+	Nice                     int               `json:"nice"`                       // Run this command at a lower scheduling priority: niceness 0-19, higher is nicer. The configured nice setting is a floor, so a call can only lower its priority further. The result reports the applied value as nice. Unix only; ignored on Windows.
+	Retries                  int               `json:"retries"`                    // Number of times to re-run the command if it exits non-zero or times out (0-10). Validation failures are never retried. Defaults to 0.
+	RetryExitCodes           []int             `json:"retry_exit_codes"`           // Only retry when the command exits with one of these codes, e.g. [52] for curl's empty reply; any other failure is returned at once. A timeout counts as exit code -1, as does a command that could not be started; error_kind tells them apart. Defaults to retrying any non-zero exit.
+	RetryDelayMs             int               `json:"retry_delay_ms"`             // Delay in milliseconds before the first retry; doubles after each further attempt. Defaults to 0.
+	Template                 string            `json:"template"`                   // Name of a configured command template to run instead of command. The rendered command goes through the normal validation.
+	TemplateArgs             map[string]string `json:"template_args"`              // Values for the template's {{.name}} placeholders. Each value is shell-quoted before substitution.
+	BypassToken              string            `json:"bypass_token"`               // Token for trusted automation that skips allowed and blocked pattern checks when it matches the configured bypass_token. A wrong token is an error. Never echoed in results or audit logs.
+	FailOnNonzero            bool              `json:"fail_on_nonzero"`            // Return an error when the command exits with a non-zero code or times out. The error message includes the full result JSON. Defaults to false, where the exit code is only reported in the result.
+	ExpectStdoutRegex        string            `json:"expect_stdout_regex"`        // Regular expression the command's stdout must match (the combined stream with combine_output), e.g. 'PASS' or '^ok '. The result gets expectation_met and, when violated, expectation_failures, and the call returns an error with the full result, as with fail_on_nonzero. Cannot be combined with stdout_file or detach.
+	ExpectExitCode           *int              `json:"expect_exit_code"`           // Exit code the command must exit with, e.g. 1 for a check that should fail; omit or pass null for no expectation. Reported like expect_stdout_regex; when set it replaces the usual 'zero means success' for fail_on_nonzero, output_format text and stop_on_error. A timeout counts as exit code -1, as does a command that could not be started; error_kind tells them apart.
+	StopOnError              bool              `json:"stop_on_error"`              // With commands, stop the batch at the first command that is rejected or exits non-zero. Defaults to false, where every command runs.
+	CombineOutput            bool              `json:"combine_output"`             // Capture stdout and stderr together in a single combined field, preserving the order in which lines were written. When false (default), stdout and stderr are returned separately.
+	StdoutFile               string            `json:"stdout_file"`                // Write the command's stdout to this file instead of returning it, for large output such as a database dump. A relative path is resolved against the working directory, and the file must be inside allowed_working_dirs. It is created or truncated, the result reports stdout_file and stdout_bytes instead of stdout, and redaction_patterns do not apply to it. Cannot be combined with combine_output, parse_stdout_json or session_id.
+	StderrFile               string            `json:"stderr_file"`                // Write the command's stderr to this file instead of returning it. Resolved and checked like stdout_file; the result reports stderr_file and stderr_bytes instead of stderr. Cannot be combined with combine_output or session_id.
+	TrimOutput               bool              `json:"trim_output"`                // Strip trailing newlines and spaces from stdout, stderr and combined before returning them, which keeps output clean when it is quoted into a prompt. Defaults to false, where output is returned byte for byte.
+	ParseStdoutJSON          bool              `json:"parse_stdout_json"`          // Parse stdout as JSON and return it as the stdout_json object instead of the stdout string, for commands like kubectl get -o json or docker inspect. If stdout is not a single JSON value it is kept and stdout_json is null with the reason in parse_error. Not available with combine_output or output_format text.
+	CompressOutput           bool              `json:"compress_output"`            // Return stdout, stderr and combined gzip-compressed and base64-encoded, with compressed: true in the result, so bulky but compressible output such as logs or diffs stays small. Output is still truncated at max_output_bytes first. Not available with parse_stdout_json or output_format text. Defaults to false.
+	Verbose                  bool              `json:"verbose"`                    // Add diagnostic fields to the result: settings_source gives the settings file that was used (path, empty for the built-in defaults), its modification time and whether its parsed form came from the cache (cache_hit), to check that an edited settings file was picked up. Defaults to false.
+	OutputFormat             string            `json:"output_format"`              // Result format: json (default) returns the full result object; text returns only stdout on success or stderr on failure (the combined stream with combine_output) and reports a non-zero exit or timeout as an error. Text saves tokens when only the output matters. Batches, dry runs and needs_confirmation results always return JSON.
 }
 
 // Call implements the PluginTool interface
@@ -39,11 +81,6 @@ func (t *ori_shell_executorTool) Call(ctx context.Context, args string) (string,
 		return "", fmt.Errorf("invalid arguments: %w", err)
 	}
 
-	// Validate required fields
-	if params.Command == "" {
-		return "", fmt.Errorf("required field 'command' is missing")
-	}
-
 	// Call the Execute method (implemented by you)
 	return t.Execute(ctx, &params)
 }
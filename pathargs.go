@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// shellWord is one word of a shell command with its quotes removed
+type shellWord struct {
+	text    string
+	expands bool // has $, a backtick or (for cmd) % outside single quotes
+}
+
+// splitShellWords splits command into words on unquoted whitespace, reading
+// quotes and backslash escapes as scanShellOperators does
+func splitShellWords(command, shell string) []shellWord {
+	posix := shell != "cmd" && shell != "powershell" && shell != "pwsh"
+	isExpansion := func(c byte) bool {
+		return c == '$' || c == '`' || (c == '%' && shell == "cmd")
+	}
+
+	var words []shellWord
+	var current strings.Builder
+	var word shellWord
+	inWord := false
+	var quote byte
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteByte(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '\\' && posix && i+1 < len(command):
+				i++
+				current.WriteByte(command[i])
+			case c == '"':
+				quote = 0
+			default:
+				word.expands = word.expands || isExpansion(c)
+				current.WriteByte(c)
+			}
+		case c == '\\' && posix && i+1 < len(command):
+			i++
+			current.WriteByte(command[i])
+			inWord = true
+		case (c == '"' || c == '\'' && shell != "cmd") && strings.IndexByte(command[i+1:], c) >= 0:
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if inWord {
+				word.text = current.String()
+				words = append(words, word)
+				current.Reset()
+				word = shellWord{}
+				inWord = false
+			}
+		default:
+			word.expands = word.expands || isExpansion(c)
+			current.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		word.text = current.String()
+		words = append(words, word)
+	}
+	return words
+}
+
+// checkPathArguments rejects a command whose arguments reach outside roots.
+// Every argument after the program is taken as a possible path, as are
+// redirection targets, the value of --flag=value options and a path attached
+// to a short option, as in -o/tmp/out; other options are skipped, and URLs
+// are left alone. Relative paths are resolved against
+// workingDir and, when the command changes directory with cd or pushd,
+// against each directory it changes to, so ".." cannot climb out of the
+// roots from either. A shell argument built from a variable or substitution
+// cannot be checked and is rejected if it could name a path. argv is used
+// instead of parsing command when set; its words are literal.
+func checkPathArguments(command string, argv []string, shell, workingDir string, roots []string) error {
+	var words []shellWord
+	var dirs []shellWord // cd and pushd targets
+	if len(argv) > 0 {
+		for _, arg := range argv[1:] {
+			words = append(words, shellWord{text: arg})
+		}
+	} else {
+		segments := []string{command}
+		if len(findShellMetacharacters(command, shell, shellOperators)) > 0 {
+			if parsed := commandSegments(command, shell); len(parsed) > 0 {
+				segments = parsed
+			}
+		}
+		for _, segment := range segments {
+			segmentWords := splitShellWords(segment, shell)
+			if len(segmentWords) == 0 {
+				continue
+			}
+			args := segmentWords[1:]
+			words = append(words, args...)
+			if program := segmentWords[0].text; program == "cd" || program == "pushd" {
+				dirs = append(dirs, changedDir(args))
+			}
+		}
+
+		// Redirection targets are dropped from the segments but name files too
+		for _, r := range commandRedirections(command, shell) {
+			words = append(words, r.target)
+		}
+	}
+
+	var rootDirs []string
+	for _, root := range roots {
+		if dir, err := normalizeDir(root); err == nil {
+			rootDirs = append(rootDirs, dir)
+		}
+	}
+
+	bases := []string{workingDir}
+	for _, dir := range dirs {
+		if dir.text == "-" {
+			return fmt.Errorf("%w: cd - returns to a directory that cannot be checked", ErrOutsidePathRoots)
+		}
+		path := expandTilde(dir.text)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+		bases = append(bases, path)
+	}
+	for _, word := range slices.Concat(words, dirs) {
+		if err := checkPathArgument(word, len(argv) > 0, bases, rootDirs, roots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedDir returns the directory cd or pushd with args changes to: the
+// first argument that is not an option, or ~ when there is none
+func changedDir(args []shellWord) shellWord {
+	for _, arg := range args {
+		if arg.text == "-" || !strings.HasPrefix(arg.text, "-") {
+			return arg
+		}
+	}
+	return shellWord{text: "~"}
+}
+
+// optionValue returns the value given in an option word: what follows = in
+// --flag=value or -f=value, or a path attached to a short option, as in
+// -o/etc/passwd or -C~/src. Other attached values like the "la" of -la are
+// taken as more option letters.
+func optionValue(option string) (string, bool) {
+	if _, value, ok := strings.Cut(option, "="); ok {
+		return value, true
+	}
+	if len(option) <= 2 || option[1] == '-' {
+		return "", false
+	}
+	value := option[2:]
+	if strings.ContainsAny(value, `/\`) || strings.HasPrefix(value, "~") || strings.HasPrefix(value, ".") {
+		return value, true
+	}
+	return "", false
+}
+
+// checkPathArgument checks one argument as described at checkPathArguments.
+// rootDirs are the normalized roots; roots are reported as configured.
+func checkPathArgument(word shellWord, literal bool, bases, rootDirs, roots []string) error {
+	text := word.text
+	if strings.HasPrefix(text, "-") {
+		value, ok := optionValue(text)
+		if !ok {
+			return nil // an option, or - for stdin
+		}
+		text = value
+	}
+	if text == "" || strings.Contains(text, "://") {
+		return nil
+	}
+	if word.expands && (strings.ContainsAny(text, `/\`) || strings.IndexAny(text, "$`%") == 0) {
+		return fmt.Errorf("%w: argument '%s' is expanded by the shell, so the path it names cannot be checked", ErrOutsidePathRoots, text)
+	}
+
+	path := text
+	if !literal {
+		path = expandTilde(path)
+		if strings.HasPrefix(path, "~") {
+			return fmt.Errorf("%w: argument '%s' names a directory that cannot be resolved", ErrOutsidePathRoots, text)
+		}
+	}
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = candidates[:0]
+		for _, base := range bases {
+			candidates = append(candidates, filepath.Join(base, path))
+		}
+	}
+	for _, candidate := range candidates {
+		resolved, err := normalizeDir(candidate)
+		if err != nil {
+			return fmt.Errorf("%w: cannot resolve argument '%s': %v", ErrOutsidePathRoots, text, err)
+		}
+		if !slices.ContainsFunc(rootDirs, func(root string) bool { return isWithinDir(resolved, root) }) {
+			return fmt.Errorf("%w: argument '%s' resolves to %s, outside %v", ErrOutsidePathRoots, text, resolved, roots)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPathArgumentsOptions(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		command string
+		wantErr bool
+	}{
+		{"sort -o/etc/x data.txt", true},
+		{"tar -C/etc -xf a.tar", true},
+		{"ssh -i~/.ssh/id_rsa host", true},
+		{"cc -I../include main.c", true},
+		{"gzip --output=/etc/x data.txt", true},
+		{"sort -o./out.txt data.txt", false},
+		{"ls -la", false},
+		{"ls -la .", false},
+		{"sort --reverse data.txt", false},
+	}
+	for _, tt := range tests {
+		err := checkPathArguments(tt.command, nil, "bash", root, []string{root})
+		if tt.wantErr && !errors.Is(err, ErrOutsidePathRoots) {
+			t.Errorf("checkPathArguments(%q) = %v, want ErrOutsidePathRoots", tt.command, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("checkPathArguments(%q) = %v, want nil", tt.command, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// configureProcessGroup is a no-op on platforms without Unix process groups.
+// On Windows, cancellation kills only the direct child process, immediately,
+// since there is no SIGTERM to send first.
+func configureProcessGroup(cmd *exec.Cmd, grace time.Duration) (stopKill func()) {
+	return func() {}
+}
+
+// setCredential is not supported without Unix credentials
+func setCredential(cmd *exec.Cmd, uid, gid *int) error {
+	if uid == nil && gid == nil {
+		return nil
+	}
+	return fmt.Errorf("run_as_uid/run_as_gid are not supported on %s", runtime.GOOS)
+}
+
+// startCommand starts cmd; there is no umask to apply on this platform
+func startCommand(cmd *exec.Cmd, umask *int) error {
+	return cmd.Start()
+}
+
+// setNice does nothing: Windows has priority classes rather than nice
+// values, so the nice setting is ignored and no nice is reported
+func setNice(cmd *exec.Cmd, nice int) bool {
+	return false
+}
+
+// maxRSSKB is unavailable without a Unix rusage, so max_rss_kb is omitted
+func maxRSSKB(state *os.ProcessState) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,130 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configureProcessGroup starts the command in its own process group and makes
+// cancellation (timeout or caller abort) kill the whole group, so children the
+// command spawned in the background are not left running. With a positive
+// grace the group first gets SIGTERM, and SIGKILL only once grace has passed,
+// so commands can release locks and flush output. The returned stopKill must
+// be called once cmd.Wait returns: it drops a pending SIGKILL, which could
+// otherwise hit an unrelated group that reused the process group id.
+func configureProcessGroup(cmd *exec.Cmd, grace time.Duration) (stopKill func()) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var mu sync.Mutex
+	var kill *time.Timer
+	cmd.Cancel = func() error {
+		if grace <= 0 {
+			return signalGroup(cmd, syscall.SIGKILL)
+		}
+		mu.Lock()
+		kill = time.AfterFunc(grace, func() { signalGroup(cmd, syscall.SIGKILL) })
+		mu.Unlock()
+		return signalGroup(cmd, syscall.SIGTERM)
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
+
+// signalGroup sends sig to every process in the command's process group
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	// A negative pid signals every process in the group
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// setCredential runs the command as the given uid and/or gid. Unset ids keep
+// the current process's value. Supplementary groups are only reset when we
+// are root, since setgroups requires privilege.
+func setCredential(cmd *exec.Cmd, uid, gid *int) error {
+	if uid == nil && gid == nil {
+		return nil
+	}
+
+	cred := &syscall.Credential{
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		NoSetGroups: os.Getuid() != 0,
+	}
+	if uid != nil {
+		cred.Uid = uint32(*uid)
+	}
+	if gid != nil {
+		cred.Gid = uint32(*gid)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
+
+// umaskMu serializes process starts against umask changes. The umask is
+// process-wide and inherited when the child is forked, so a start under a
+// custom umask holds it exclusively and every other start holds it shared.
+var umaskMu sync.RWMutex
+
+// startCommand starts cmd with umask as its file mode creation mask, or with
+// the agent's own umask if umask is nil. The previous umask is restored as
+// soon as the child has started.
+func startCommand(cmd *exec.Cmd, umask *int) error {
+	if umask == nil {
+		umaskMu.RLock()
+		defer umaskMu.RUnlock()
+		return cmd.Start()
+	}
+
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	previous := syscall.Umask(*umask)
+	defer syscall.Umask(previous)
+	return cmd.Start()
+}
+
+// setNice sets the niceness of the started command's process group, which
+// also covers anything it forked before this ran. It reports whether nice
+// was applied; a failure is logged, since the command is already running.
+func setNice(cmd *exec.Cmd, nice int) bool {
+	if nice == 0 {
+		return false
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, nice); err != nil {
+		fmt.Fprintf(os.Stderr, "ori-shell-executor: failed to set nice %d: %v\n", nice, err)
+		return false
+	}
+	return true
+}
+
+// maxRSSKB returns the peak resident set size of the exited process in
+// kilobytes. Darwin reports ru_maxrss in bytes, other Unixes in kilobytes.
+func maxRSSKB(state *os.ProcessState) (int64, bool) {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || usage == nil {
+		return 0, false
+	}
+	maxRSS := int64(usage.Maxrss)
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		maxRSS /= 1024
+	}
+	return maxRSS, true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// runRegistry tracks the cancel function of every command that is currently
+// executing, keyed by run id, so the cancel action can stop one from another
+// call. Cancelling the run's context kills its whole process group.
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]context.CancelFunc
+}
+
+var activeRuns = &runRegistry{runs: make(map[string]context.CancelFunc)}
+
+// register records cancel under id, rejecting an id that is already running
+func (r *runRegistry) register(id string, cancel context.CancelFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.runs[id]; exists {
+		return fmt.Errorf("a command with run_id '%s' is already running", id)
+	}
+	r.runs[id] = cancel
+	return nil
+}
+
+// unregister forgets id once its command has finished
+func (r *runRegistry) unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.runs, id)
+}
+
+// cancel cancels the run with id, reporting whether it was running
+func (r *runRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	cancel, ok := r.runs[id]
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// newRunID returns a random identifier for a run
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// selftestCommand is the harmless command the selftest action runs, and the
+// output it must produce
+const (
+	selftestCommand = "echo ori-selftest"
+	selftestOutput  = "ori-selftest"
+)
+
+// probedShells are the shell binaries the selftest action looks for on PATH
+var probedShells = []string{"sh", "bash", "zsh", "fish", "pwsh", "powershell", "cmd"}
+
+// selftest runs selftestCommand through validation and execution with
+// metacharacters disabled and reports which stages worked, along with the
+// OS and the shells found on PATH. The configured pattern lists are not
+// applied, since an allowlist need not include echo.
+func (t *ori_shell_executorTool) selftest(ctx context.Context, settings Settings) (string, error) {
+	checks := map[string]bool{
+		"validation":     false,
+		"execution":      false,
+		"output_capture": false,
+		"json_encoding":  false,
+	}
+	result := map[string]interface{}{
+		"action":  actionSelftest,
+		"command": selftestCommand,
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"checks":  checks,
+	}
+
+	shells := make(map[string]string)
+	for _, name := range probedShells {
+		if path, err := exec.LookPath(name); err == nil {
+			shells[name] = path
+		}
+	}
+	result["available_shells"] = shells
+
+	shell, err := resolveShell(fallbackShell(settings))
+	if err == nil {
+		err = checkShellAllowed(shell, settings.AllowedShells)
+	}
+	if err == nil {
+		result["shell"] = shell
+		testSettings := settings
+		testSettings.AllowShellMetacharacters = false
+		testSettings.AllowedPatterns = nil
+		testSettings.AllowedSubcommands = nil
+		testSettings.BlockedPatterns = nil
+		_, err = t.validateCommand(selftestCommand, shell, testSettings)
+	}
+	if err == nil {
+		checks["validation"] = true
+		var run map[string]interface{}
+		run, err = t.executeCommand(ctx, execOptions{
+			Command:        selftestCommand,
+			WorkingDir:     os.TempDir(),
+			TimeoutSeconds: 10,
+			Shell:          shell,
+			EnvAllowlist:   settings.EnvAllowlist,
+			EnvBlocklist:   settings.EnvBlocklist,
+			PathOverride:   settings.PathOverride,
+			MaxOutputBytes: settings.MaxOutputBytes,
+			TruncateMode:   settings.TruncateMode,
+			MaxConcurrent:  settings.MaxConcurrent,
+			RunAsUID:       settings.RunAsUID,
+			RunAsGID:       settings.RunAsGID,
+			CommandPrefix:  settings.CommandPrefix,
+		})
+		if err == nil {
+			result["exit_code"] = run["exit_code"]
+			stdout, _ := run["stdout"].(string)
+			result["stdout"] = stdout
+			checks["execution"] = run["exit_code"] == 0
+			checks["output_capture"] = strings.TrimSpace(stdout) == selftestOutput
+			_, encodeErr := json.Marshal(run)
+			checks["json_encoding"] = encodeErr == nil
+			if runErr, ok := run["error"].(string); ok {
+				result["error"] = runErr
+			}
+		}
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+
+	ok := true
+	for _, passed := range checks {
+		ok = ok && passed
+	}
+	result["ok"] = ok
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shellSession is a long-lived shell that keeps cd, exported variables and
+// shell variables between calls. Commands are written to its stdin and their
+// output is delimited by a random marker printed after each one.
+type shellSession struct {
+	id    string
+	shell string
+
+	cmd    *exec.Cmd
+	cancel context.CancelFunc // kills the shell's process group
+	stdin  io.WriteCloser
+	stdout <-chan []byte
+	stderr <-chan []byte
+	exited chan struct{} // closed once the shell has exited
+
+	mu          sync.Mutex // serializes commands
+	ended       bool
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+// sessionRegistry holds the open sessions by id
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*shellSession
+}
+
+var shellSessions = &sessionRegistry{sessions: make(map[string]*shellSession)}
+
+// getOrStart returns the session with id, starting a shell for it from opts
+// if there is none. The bool reports whether the session was created.
+func (r *sessionRegistry) getOrStart(id string, opts execOptions, idleTimeout time.Duration) (*shellSession, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.sessions[id]; ok {
+		return s, false, nil
+	}
+
+	s, err := startSession(id, opts, idleTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	r.sessions[id] = s
+	return s, true, nil
+}
+
+// remove forgets s if it is still the session registered under its id
+func (r *sessionRegistry) remove(s *shellSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.id] == s {
+		delete(r.sessions, s.id)
+	}
+}
+
+// close ends the session with id, reporting whether it existed
+func (r *sessionRegistry) close(id string) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if ok {
+		s.close()
+	}
+	return ok
+}
+
+// startSession launches the shell for a new session. The shell reads its
+// script from stdin, runs in its own process group and is reaped after
+// idleTimeout without a command.
+func startSession(id string, opts execOptions, idleTimeout time.Duration) (*shellSession, error) {
+	if len(opts.CommandPrefix) == 0 {
+		if err := checkShellAvailable(opts.Shell, opts.PathOverride); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	commandLine := slices.Concat(opts.CommandPrefix, []string{opts.Shell})
+	cmd := exec.CommandContext(ctx, commandLine[0], commandLine[1:]...)
+	applyPathOverride(cmd, commandLine[0], opts.PathOverride)
+	configureProcessGroup(cmd, 0)
+	if err := setCredential(cmd, opts.RunAsUID, opts.RunAsGID); err != nil {
+		cancel()
+		return nil, err
+	}
+	cmd.Dir = opts.WorkingDir
+	cmd.Env = commandEnv(opts.Env, opts)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := startCommand(cmd, opts.Umask); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start session shell: %w", err)
+	}
+	setNice(cmd, opts.Nice)
+
+	stdoutCh := make(chan []byte, 64)
+	stderrCh := make(chan []byte, 64)
+	s := &shellSession{
+		id:          id,
+		shell:       opts.Shell,
+		cmd:         cmd,
+		cancel:      cancel,
+		stdin:       stdin,
+		stdout:      stdoutCh,
+		stderr:      stderrCh,
+		exited:      make(chan struct{}),
+		idleTimeout: idleTimeout,
+	}
+
+	// Wait may only run once both pipes are fully read
+	var pumps sync.WaitGroup
+	pumps.Add(2)
+	go pumpOutput(stdout, stdoutCh, &pumps)
+	go pumpOutput(stderr, stderrCh, &pumps)
+	go func() {
+		pumps.Wait()
+		cmd.Wait()
+		close(s.exited)
+	}()
+
+	s.idle = time.AfterFunc(idleTimeout, func() {
+		shellSessions.remove(s)
+		s.close()
+	})
+	return s, nil
+}
+
+// pumpOutput forwards everything read from r to ch, closing ch at EOF
+func pumpOutput(r io.Reader, ch chan<- []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(ch)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			ch <- bytes.Clone(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close kills the session's shell and everything it started. Leftover
+// output is drained so the pipe readers can finish and the shell be reaped.
+func (s *shellSession) close() {
+	s.idle.Stop()
+	s.stdin.Close()
+	s.cancel()
+	go drainOutput(s.stdout)
+	go drainOutput(s.stderr)
+}
+
+// drainOutput discards everything sent on ch until it is closed
+func drainOutput(ch <-chan []byte) {
+	for range ch {
+	}
+}
+
+// run executes command in the session and returns its result. The command
+// must already have passed validation. Its stdin is /dev/null so it cannot
+// swallow the script that follows it. A timeout or cancellation ends the
+// session, since the shell is then in an unknown state.
+func (s *shellSession) run(ctx context.Context, command string, opts execOptions) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.idle.Stop() || s.ended {
+		return nil, fmt.Errorf("session '%s' has ended", s.id)
+	}
+	defer func() {
+		if !s.ended {
+			s.idle.Reset(s.idleTimeout)
+		}
+	}()
+
+	marker := "__ORI_SESSION_" + newRunID() + "__"
+	redirect := ""
+	if opts.CombineOutput {
+		redirect = " 2>&1"
+	}
+	script := fmt.Sprintf("{\n%s\n} </dev/null%s\nprintf '%%s %%d\\n' '%s' \"$?\"\nprintf '%%s\\n' '%s' >&2\n",
+		command, redirect, marker, marker)
+
+	stdoutLimit, stderrLimit := opts.streamLimits()
+	if opts.CombineOutput {
+		stdoutLimit = opts.MaxOutputBytes
+	}
+	stdout := &markedStream{ch: s.stdout, buf: newCappedBuffer(stdoutLimit, opts.TruncateMode), marker: []byte(marker)}
+	stderr := &markedStream{ch: s.stderr, buf: newCappedBuffer(stderrLimit, opts.TruncateMode), marker: []byte(marker)}
+
+	timer := time.NewTimer(time.Duration(opts.TimeoutSeconds) * time.Second)
+	defer timer.Stop()
+
+	startedAt := time.Now()
+	var failure, errorKind string
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		failure, errorKind = fmt.Sprintf("session shell is not accepting input: %v", err), errorKindExecError
+	}
+	for failure == "" && !(stdout.done && stderr.done) {
+		select {
+		case chunk, ok := <-stdout.ch:
+			stdout.receive(chunk, ok)
+		case chunk, ok := <-stderr.ch:
+			stderr.receive(chunk, ok)
+		case <-timer.C:
+			failure, errorKind = fmt.Sprintf("command timed out after %d seconds", opts.TimeoutSeconds), errorKindTimeout
+		case <-ctx.Done():
+			failure, errorKind = "command cancelled", errorKindCancelled
+		}
+	}
+	finishedAt := time.Now()
+	// Keep the tail held back while looking for the marker; after a timeout it
+	// is often the most telling part of the output
+	for _, stream := range []*markedStream{stdout, stderr} {
+		if !stream.done {
+			stream.buf.Write(stream.pending)
+			stream.pending = nil
+		}
+	}
+
+	// Without a marker the shell exited, e.g. because the command ran exit
+	code, err := strconv.Atoi(stdout.status)
+	if failure != "" || err != nil {
+		s.ended = true
+		shellSessions.remove(s)
+		s.close()
+		<-s.exited
+		if failure == "" {
+			code = s.cmd.ProcessState.ExitCode()
+		} else {
+			code = -1
+		}
+	}
+
+	captured := []*cappedBuffer{stdout.buf, stderr.buf}
+	if opts.OutputEncoding != nil {
+		for _, buf := range captured {
+			if decodeErr := buf.Decode(opts.OutputEncoding); decodeErr != nil {
+				return nil, fmt.Errorf("failed to decode command output: %w", decodeErr)
+			}
+		}
+	}
+	redacted := 0
+	for _, buf := range captured {
+		redacted += buf.Redact(opts.Redactions)
+	}
+
+	result := map[string]interface{}{
+		"command":     command,
+		"session_id":  s.id,
+		"shell":       s.shell,
+		"exit_code":   code,
+		"duration_ms": finishedAt.Sub(startedAt).Milliseconds(),
+		"started_at":  startedAt.UTC().Format(time.RFC3339Nano),
+		"finished_at": finishedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if opts.CombineOutput {
+		result["combined"] = stdout.buf.String()
+		result["truncated"] = stdout.buf.Truncated()
+	} else {
+		result["stdout"] = stdout.buf.String()
+		result["stderr"] = stderr.buf.String()
+		result["truncated"] = stdout.buf.Truncated() || stderr.buf.Truncated()
+		result["stdout_truncated"] = stdout.buf.Truncated()
+		result["stderr_truncated"] = stderr.buf.Truncated()
+	}
+	if redacted > 0 {
+		result["redactions"] = redacted
+	}
+	if failure != "" {
+		result["error"] = failure
+		result["error_kind"] = errorKind
+		switch errorKind {
+		case errorKindTimeout:
+			result["timed_out"] = true
+		case errorKindCancelled:
+			result["cancelled"] = true
+		}
+	}
+	if s.ended {
+		result["session_ended"] = true
+	}
+	return result, nil
+}
+
+// markedStream collects one command's output from a session pipe up to the
+// marker line that follows it. Bytes that may be the start of the marker are
+// held back; everything else goes straight to buf so the output cap holds.
+type markedStream struct {
+	ch      <-chan []byte
+	buf     *cappedBuffer
+	marker  []byte
+	pending []byte
+	status  string // text after the marker, the exit code on stdout
+	done    bool
+}
+
+// receive handles one read from ch; ok is false once the pipe is closed
+func (m *markedStream) receive(chunk []byte, ok bool) {
+	if !ok {
+		m.buf.Write(m.pending)
+		m.pending = nil
+		m.ch = nil
+		m.done = true
+		return
+	}
+
+	m.pending = append(m.pending, chunk...)
+	if idx := bytes.Index(m.pending, m.marker); idx >= 0 {
+		end := bytes.IndexByte(m.pending[idx:], '\n')
+		if end < 0 {
+			return
+		}
+		m.buf.Write(m.pending[:idx])
+		m.status = strings.TrimSpace(string(m.pending[idx+len(m.marker) : idx+end]))
+		m.pending = nil
+		m.ch = nil
+		m.done = true
+		return
+	}
+
+	if keep := len(m.marker) + 32; len(m.pending) > keep {
+		m.buf.Write(m.pending[:len(m.pending)-keep])
+		m.pending = slices.Clone(m.pending[len(m.pending)-keep:])
+	}
+}
+
+// executeInSession runs opts.Command in the session with sessionID, starting
+// the session from opts on first use. The working directory, environment and
+// shell only take effect when the session starts.
+func executeInSession(ctx context.Context, sessionID string, opts execOptions, idleTimeoutSeconds int) (map[string]interface{}, error) {
+	if err := execSlots.acquire(ctx, opts.MaxConcurrent); err != nil {
+		return nil, fmt.Errorf("cancelled while waiting for an execution slot: %w", err)
+	}
+	defer execSlots.release()
+
+	session, created, err := shellSessions.getOrStart(sessionID, opts, time.Duration(idleTimeoutSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	result, err := session.run(ctx, opts.Command, opts)
+	if err != nil {
+		return nil, err
+	}
+	result["session_created"] = created
+	return result, nil
+}
+
+// closeSession ends the session with sessionID and kills its shell
+func closeSession(sessionID string) (string, error) {
+	if sessionID == "" {
+		return "", fmt.Errorf("session_id is required for the close_session action")
+	}
+	if !shellSessions.close(sessionID) {
+		return "", fmt.Errorf("no open session with session_id '%s'", sessionID)
+	}
+
+	result := map[string]interface{}{
+		"action":     actionCloseSession,
+		"session_id": sessionID,
+		"closed":     true,
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// rejectionStats counts the commands rejected by policy since the plugin
+// started, by category, so monitoring can alert on repeated attempts
+type rejectionStats struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	blocked       int
+	notAllowed    int
+	metacharacter int
+	tooLong       int
+	control       int
+	outsideRoots  int
+	lastRejection time.Time
+}
+
+var rejections = &rejectionStats{startedAt: time.Now()}
+
+// record counts err if it is a policy rejection; other errors are ignored
+func (s *rejectionStats) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrBlockedPattern):
+		s.blocked++
+	case errors.Is(err, ErrNotAllowed):
+		s.notAllowed++
+	case errors.Is(err, ErrShellMetacharacters):
+		s.metacharacter++
+	case errors.Is(err, ErrCommandTooLong):
+		s.tooLong++
+	case errors.Is(err, ErrControlCharacter):
+		s.control++
+	case errors.Is(err, ErrOutsidePathRoots):
+		s.outsideRoots++
+	default:
+		return
+	}
+	s.lastRejection = time.Now()
+}
+
+// statsResult reports the rejection counts for the get_stats action
+func statsResult() (string, error) {
+	rejections.mu.Lock()
+	counts := map[string]interface{}{
+		"total":              rejections.blocked + rejections.notAllowed + rejections.metacharacter + rejections.tooLong + rejections.control + rejections.outsideRoots,
+		"blocked":            rejections.blocked,
+		"not_allowed":        rejections.notAllowed,
+		"metacharacter":      rejections.metacharacter,
+		"too_long":           rejections.tooLong,
+		"control_character":  rejections.control,
+		"outside_path_roots": rejections.outsideRoots,
+	}
+	result := map[string]interface{}{
+		"action":     actionGetStats,
+		"started_at": rejections.startedAt.UTC().Format(time.RFC3339Nano),
+		"rejections": counts,
+	}
+	if !rejections.lastRejection.IsZero() {
+		result["last_rejection_at"] = rejections.lastRejection.UTC().Format(time.RFC3339Nano)
+	}
+	rejections.mu.Unlock()
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}